@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"go.bbkane.com/gocolor"
+)
+
+// alternateSep separates a src name from the conditions that choose it (like dot-gitconfig##os.linux)
+const alternateSep = "##"
+
+// machineFacts are what alternates are chosen by
+type machineFacts struct {
+	// os is runtime.GOOS
+	os   string
+	host string
+}
+
+func currentMachine() machineFacts {
+	host, err := os.Hostname()
+	if err != nil {
+		host = ""
+	}
+	return machineFacts{os: runtime.GOOS, host: host}
+}
+
+// chosenAlternate is the variant of an alternate src path (like dot-gitconfig##os.linux)
+// chosen for this machine. It's linked to the path without the ##suffix.
+type chosenAlternate struct {
+	src    string
+	link   string
+	reason string
+}
+
+func (t chosenAlternate) ColorString(color *gocolor.Color) string {
+	return fmt.Sprintf(
+		"- %s: %s\n  %s: %s\n  %s: %s",
+		color.Add(color.Bold, "src"),
+		t.src,
+		color.Add(color.Bold, "link"),
+		t.link,
+		color.Add(color.Bold, "reason"),
+		t.reason,
+	)
+}
+
+// alternateScore returns how well the ##conditions of an alternate match m, and why.
+// Every condition must match. Host conditions beat os conditions, which beat default.
+func alternateScore(conditions string, m machineFacts) (int, string, error) {
+	score := 0
+	var reasons []string
+	for _, cond := range strings.Split(conditions, ",") {
+		key, value, _ := strings.Cut(cond, ".")
+		switch key {
+		case "default":
+			if value != "" {
+				return 0, "", fmt.Errorf("default alternate condition doesn't take a value: %s", cond)
+			}
+			score++
+			reasons = append(reasons, "default")
+		case "os":
+			if !strings.EqualFold(value, m.os) {
+				return 0, "", nil
+			}
+			score += 2
+			reasons = append(reasons, "os is "+m.os)
+		case "host":
+			shortHost, _, _ := strings.Cut(m.host, ".")
+			if value == "" || (!strings.EqualFold(value, m.host) && !strings.EqualFold(value, shortHost)) {
+				return 0, "", nil
+			}
+			score += 4
+			reasons = append(reasons, "host is "+m.host)
+		default:
+			return 0, "", fmt.Errorf("unknown alternate condition (expected default, os.<os>, or host.<hostname>): %s", cond)
+		}
+	}
+	return score, strings.Join(reasons, " and "), nil
+}
+
+// hasAlternates reports whether names (the entries of a dir) has alternates for base
+func hasAlternates(base string, names []string) bool {
+	return slices.ContainsFunc(names, func(name string) bool {
+		return strings.HasPrefix(name, base+alternateSep)
+	})
+}
+
+// chooseAlternate returns the name of the variant of base in names (the entries of a dir)
+// that best matches m, and why it was chosen. A variant without a ##suffix is used
+// when no alternate matches. It returns "" if nothing matches.
+func chooseAlternate(base string, names []string, m machineFacts) (string, string, error) {
+	chosen := ""
+	reason := ""
+	best := -1
+	tied := false
+	for _, name := range names {
+		score := 0
+		why := "no alternate matches this machine"
+		if name != base {
+			conditions, isAlt := strings.CutPrefix(name, base+alternateSep)
+			if !isAlt {
+				continue
+			}
+			var err error
+			score, why, err = alternateScore(conditions, m)
+			if err != nil {
+				return "", "", fmt.Errorf("%s: %w", name, err)
+			}
+			if why == "" {
+				continue
+			}
+		}
+		switch {
+		case score > best:
+			chosen, reason, best, tied = name, why, score, false
+		case score == best:
+			tied = true
+		}
+	}
+	if tied {
+		return "", "", fmt.Errorf("several alternates for %s match this machine equally well. Make their conditions more specific", base)
+	}
+	return chosen, reason, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+	"go.bbkane.com/warg/path"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is the config file fling looks for in the cwd and its parents
+const configFileName = "fling.yaml"
+
+// configPackage is a src dir declared in the config file, along with how to link it
+type configPackage struct {
+	name string
+	// src is the absolute src dir
+	src string
+	// srcLine is the line src was declared on, for errors about it
+	srcLine        int
+	linkDir        string
+	ignorePatterns []string
+	isDotfiles     bool
+	// renameRules are applied after dotfiles (see renameRules)
+	renameRules []string
+}
+
+// config is a parsed fling.yaml. A config looks like:
+//
+//	packages:
+//	  home:
+//	    src: home # relative to the config file's dir
+//	    linkDir: "~" # default "~"
+//	    ignore: ["README.*"] # default ["README.*"]
+//	    dotfiles: true # default true
+//	    rename: ["suffix:.symlink:"] # default []
+type config struct {
+	path string
+	// packages are in the order they're declared
+	packages []configPackage
+}
+
+// findConfig returns the path of the config file in dir or its closest parent that has one,
+// or "" if there isn't one
+func findConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get abs path to search for %s: %w", configFileName, err)
+	}
+	for {
+		p := filepath.Join(dir, configFileName)
+		info, err := os.Stat(p)
+		if err == nil && info.Mode().IsRegular() {
+			return p, nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("couldn't check for config file: %w", err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// configParser collects every error in a config file instead of stopping at the first
+type configParser struct {
+	path string
+	errs []error
+	// srcs maps the src dirs of the packages parsed so far to their package names
+	srcs map[string]string
+}
+
+func (cp *configParser) errorf(n *yaml.Node, format string, args ...any) {
+	cp.errs = append(cp.errs, fmt.Errorf("%s:%d:%d: %s", cp.path, n.Line, n.Column, fmt.Sprintf(format, args...)))
+}
+
+// mapping returns the key and value nodes of the mapping n, in order. It reports
+// duplicate and unknown keys (if known isn't nil), and keys that aren't strings.
+func (cp *configParser) mapping(n *yaml.Node, what string, known []string) ([]*yaml.Node, []*yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		cp.errorf(n, "%s must be a mapping", what)
+		return nil, nil
+	}
+	var keys []*yaml.Node
+	var values []*yaml.Node
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		switch {
+		case k.Kind != yaml.ScalarNode || k.Value == "":
+			cp.errorf(k, "%s keys must be non-empty strings", what)
+		case seen[k.Value]:
+			cp.errorf(k, "duplicate key in %s: %s", what, k.Value)
+		case known != nil && !slices.Contains(known, k.Value):
+			cp.errorf(k, "unknown key in %s: %s (expected one of %v)", what, k.Value, known)
+		default:
+			seen[k.Value] = true
+			keys = append(keys, k)
+			values = append(values, v)
+		}
+	}
+	return keys, values
+}
+
+// str returns the string value of the scalar n
+func (cp *configParser) str(n *yaml.Node, what string) (string, bool) {
+	// a bare ~ is null in YAML, but here it's the home dir
+	if n.Kind != yaml.ScalarNode || (n.Tag == "!!null" && n.Value != "~") {
+		cp.errorf(n, "%s must be a string", what)
+		return "", false
+	}
+	if n.Value == "" {
+		cp.errorf(n, "%s must not be empty", what)
+		return "", false
+	}
+	return n.Value, true
+}
+
+// dirPath expands ~ in p and makes it absolute relative to the config file's dir
+func (cp *configParser) dirPath(p string) string {
+	p = path.New(p).MustExpand()
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(cp.path), p)
+	}
+	return filepath.Clean(p)
+}
+
+func (cp *configParser) parsePackage(name string, n *yaml.Node) configPackage {
+	pkg := configPackage{
+		name:           name,
+		src:            "",
+		srcLine:        n.Line,
+		linkDir:        cp.dirPath("~"),
+		ignorePatterns: defaultIgnorePatterns(),
+		isDotfiles:     true,
+		renameRules:    []string{},
+	}
+	what := "package " + name
+	keys, values := cp.mapping(n, what, []string{"src", "linkDir", "ignore", "dotfiles", "rename"})
+	if n.Kind != yaml.MappingNode {
+		return pkg
+	}
+	hasSrc := false
+	for i, k := range keys {
+		v := values[i]
+		switch k.Value {
+		case "src":
+			hasSrc = true
+			pkg.srcLine = v.Line
+			if s, ok := cp.str(v, what+" src"); ok {
+				pkg.src = cp.dirPath(s)
+				// they'd share their src dir options, and one would be silently dropped
+				if other, found := cp.srcs[pkg.src]; found {
+					cp.errorf(v, "%s src is already package %s src: %s", what, other, pkg.src)
+				}
+				cp.srcs[pkg.src] = name
+			}
+		case "linkDir":
+			if s, ok := cp.str(v, what+" linkDir"); ok {
+				pkg.linkDir = cp.dirPath(s)
+			}
+		case "ignore":
+			if v.Kind != yaml.SequenceNode {
+				cp.errorf(v, "%s ignore must be a list of regexes", what)
+				continue
+			}
+			pkg.ignorePatterns = []string{}
+			for _, e := range v.Content {
+				pattern, ok := cp.str(e, what+" ignore pattern")
+				if !ok {
+					continue
+				}
+				_, err := regexp.Compile(pattern)
+				if err != nil {
+					cp.errorf(e, "invalid %s ignore pattern: %v", what, err)
+					continue
+				}
+				pkg.ignorePatterns = append(pkg.ignorePatterns, pattern)
+			}
+		case "dotfiles":
+			err := v.Decode(&pkg.isDotfiles)
+			if v.Kind != yaml.ScalarNode || v.Tag != "!!bool" || err != nil {
+				cp.errorf(v, "%s dotfiles must be true or false", what)
+			}
+		case "rename":
+			if v.Kind != yaml.SequenceNode {
+				cp.errorf(v, "%s rename must be a list of rename rules", what)
+				continue
+			}
+			for _, e := range v.Content {
+				rule, ok := cp.str(e, what+" rename rule")
+				if !ok {
+					continue
+				}
+				_, err := parseRenameRule(rule)
+				if err != nil {
+					cp.errorf(e, "%s: %v", what, err)
+					continue
+				}
+				pkg.renameRules = append(pkg.renameRules, rule)
+			}
+		}
+	}
+	if !hasSrc {
+		cp.errorf(n, "%s is missing src", what)
+	}
+	return pkg
+}
+
+// parseConfig parses the config file at p with contents data. It returns every problem
+// with the config, each starting with p:line:column.
+func parseConfig(p string, data []byte) (*config, []error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return nil, []error{fmt.Errorf("couldn't get abs path for config file: %w", err)}
+	}
+	cp := configParser{path: p, errs: nil, srcs: make(map[string]string)}
+	cfg := &config{path: p, packages: nil}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %w", p, err)}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, []error{fmt.Errorf("%s:1:1: config is empty", p)}
+	}
+	root := doc.Content[0]
+
+	keys, values := cp.mapping(root, "config", []string{"packages"})
+	hasPackages := false
+	for i, k := range keys {
+		if k.Value != "packages" {
+			continue
+		}
+		hasPackages = true
+		names, pkgNodes := cp.mapping(values[i], "packages", nil)
+		if values[i].Kind == yaml.MappingNode && len(names) == 0 {
+			cp.errorf(values[i], "packages must not be empty")
+		}
+		for j, name := range names {
+			cfg.packages = append(cfg.packages, cp.parsePackage(name.Value, pkgNodes[j]))
+		}
+	}
+	if root.Kind == yaml.MappingNode && !hasPackages {
+		cp.errorf(root, "config is missing packages")
+	}
+	if len(cp.errs) > 0 {
+		return nil, cp.errs
+	}
+	return cfg, nil
+}
+
+func readConfig(p string) (*config, []error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, []error{fmt.Errorf("couldn't read config file: %w", err)}
+	}
+	return parseConfig(p, data)
+}
+
+// selectPackages returns the packages named by names, in the order they're declared,
+// or all packages if names is empty
+func (c *config) selectPackages(names []string) ([]configPackage, error) {
+	if len(names) == 0 {
+		return c.packages, nil
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(c.packages, func(pkg configPackage) bool { return pkg.name == name }) {
+			return nil, fmt.Errorf("package not found in %s: %s", c.path, name)
+		}
+	}
+	var ret []configPackage
+	for _, pkg := range c.packages {
+		if slices.Contains(names, pkg.name) {
+			ret = append(ret, pkg)
+		}
+	}
+	return ret, nil
+}
+
+// configPath returns the --config flag, or the config file found by searching upward
+// from the cwd (see findConfig)
+func configPath(ctx warg.CmdContext) (string, error) {
+	if configF, exists := ctx.Flags["--config"]; exists {
+		return configF.(path.Path).MustExpand(), nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get cwd to search for %s: %w", configFileName, err)
+	}
+	return findConfig(cwd)
+}
+
+func configValidate(ctx warg.CmdContext) error {
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	p, err := configPath(ctx)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return fmt.Errorf("no %s found in the current dir or its parents. Pass --config to use another file", configFileName)
+	}
+
+	cfg, errs := readConfig(p)
+	if cfg != nil {
+		// missing src dirs aren't schema errors (unlink --manifest still works without them), but they're worth knowing about
+		for _, pkg := range cfg.packages {
+			info, err := os.Stat(pkg.src)
+			if err != nil || !info.IsDir() {
+				errs = append(errs, fmt.Errorf("%s:%d: package %s src dir doesn't exist: %s", cfg.path, pkg.srcLine, pkg.name, pkg.src))
+			}
+		}
+	}
+
+	f := bufio.NewWriter(os.Stdout)
+	if len(errs) > 0 {
+		fPrintErrorHeader(f, &color, "Config errors:")
+		for _, e := range errs {
+			fmt.Fprintf(f, "- %v\n", e)
+		}
+		fmt.Fprintln(f)
+		f.Flush()
+		return fmt.Errorf("%s has %d error(s)", p, len(errs))
+	}
+
+	fPrintHeader(f, &color, "Packages:")
+	for _, pkg := range cfg.packages {
+		fmt.Fprintf(f, "- %s: %s\n", color.Add(color.Bold, "name"), pkg.name)
+		fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "src"), pkg.src)
+		fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "linkDir"), pkg.linkDir)
+	}
+	fmt.Fprintln(f)
+	fmt.Fprint(f, color.Add(color.Bold+color.FgGreenBright, fmt.Sprintf("Valid config: %s\n", p)))
+	return f.Flush()
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sameFilesystem reports whether the existing paths a and b are on the same volume (like
+// C:), so os.Rename can move a into b's dir
+func sameFilesystem(a string, b string) (bool, error) {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(a), filepath.VolumeName(b)), nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameFilesystem reports whether the existing paths a and b are on the same filesystem,
+// so os.Rename can move a into b's dir
+func sameFilesystem(a string, b string) (bool, error) {
+	aInfo, err := os.Lstat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Lstat(b)
+	if err != nil {
+		return false, err
+	}
+	aStat, aOK := aInfo.Sys().(*syscall.Stat_t)
+	bStat, bOK := bInfo.Sys().(*syscall.Stat_t)
+	if !aOK || !bOK {
+		// let os.Rename find out
+		return true, nil
+	}
+	return aStat.Dev == bStat.Dev, nil
+}
@@ -7,6 +7,7 @@ require (
 	github.com/stretchr/testify v1.11.1
 	go.bbkane.com/gocolor v0.0.7
 	go.bbkane.com/warg v0.40.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,5 +22,4 @@ require (
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
 	golang.org/x/sys v0.44.0 // indirect
 	golang.org/x/term v0.43.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ignoreFileName is the name of the gitignore-style files in src dirs. An ignore file's
+// rules apply to the dir it's in and everything below it.
+const ignoreFileName = ".flingignore"
+
+// ignoreRule is a pattern in an ignore file. Like gitignore:
+//   - blank lines and lines starting with # are skipped. Start a pattern with \# or \! to match a literal # or !
+//   - * and ? match anything but /, and [a-z] and [!a-z] match a character in (or not in) a range
+//   - a leading **/ matches in any dir, a trailing /** matches everything inside, and /**/ matches zero or more dirs
+//   - a trailing / only matches dirs
+//   - a leading ! re-includes paths an earlier rule ignored (but not paths in ignored dirs, which aren't walked)
+//   - patterns with a / at the start or in the middle match the path relative to the ignore file's dir.
+//     Other patterns match the name at any depth
+type ignoreRule struct {
+	// source is where the rule is from: the ignore file and line, or --ignore-path
+	source string
+	// text is the pattern as written
+	text string
+	// dir is the ignore file's dir
+	dir      string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	re       *regexp.Regexp
+}
+
+func (r ignoreRule) String() string {
+	return r.source + ": " + r.text
+}
+
+// globToRegexp translates the gitignore glob (without a leading ! or /, or a trailing /) into a regex
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		atSegmentStart := i == 0 || glob[i-1] == '/'
+		switch {
+		case atSegmentStart && strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case atSegmentStart && glob[i:] == "**":
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\':
+			if i+1 == len(glob) {
+				return "", errors.New("pattern ends with \\")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				return "", errors.New("unterminated [ in pattern")
+			}
+			class := glob[i+1 : i+1+end]
+			if negated, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + negated
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// parseIgnoreRule parses a line from source (an ignore file in dir and the line number). It
+// returns false for blank lines and comments.
+func parseIgnoreRule(dir string, source string, line string) (ignoreRule, bool, error) {
+	text := strings.TrimRight(line, " \t\r")
+	r := ignoreRule{
+		source:   source,
+		text:     text,
+		dir:      dir,
+		negate:   false,
+		dirOnly:  false,
+		anchored: false,
+		re:       nil,
+	}
+	if text == "" || strings.HasPrefix(text, "#") {
+		return r, false, nil
+	}
+	pattern := text
+	if p, ok := strings.CutPrefix(pattern, "!"); ok {
+		r.negate = true
+		pattern = p
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if p, ok := strings.CutSuffix(pattern, "/"); ok {
+		r.dirOnly = true
+		pattern = p
+	}
+	r.anchored = strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return r, false, fmt.Errorf("%s: empty pattern", source)
+	}
+	expr, err := globToRegexp(pattern)
+	if err == nil {
+		r.re, err = regexp.Compile(expr)
+	}
+	if err != nil {
+		return r, false, fmt.Errorf("%s: invalid pattern: %s: %w", source, text, err)
+	}
+	return r, true, nil
+}
+
+// readIgnoreFile reads the rules of the ignore file in dir, if there is one
+func readIgnoreFile(dir string) ([]ignoreRule, error) {
+	file := filepath.Join(dir, ignoreFileName)
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read ignore file: %w", err)
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		r, isRule, err := parseIgnoreRule(dir, fmt.Sprintf("%s:%d", file, lineNum), scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if isRule {
+			rules = append(rules, r)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read ignore file: %w", err)
+	}
+	return rules, nil
+}
+
+// matches reports whether r matches the path p (inside r.dir)
+func (r ignoreRule) matches(p string, isDir bool) bool {
+	rel, err := filepath.Rel(r.dir, p)
+	if err != nil {
+		return false
+	}
+	return r.matchesRel(rel, isDir)
+}
+
+// matchesRel reports whether r matches the path rel, relative to r.dir
+func (r ignoreRule) matchesRel(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		return r.re.MatchString(filepath.Base(rel))
+	}
+	return r.re.MatchString(filepath.ToSlash(rel))
+}
+
+// matchesRelOrParent reports whether r matches rel or one of its parent dirs, so a rule
+// that matches a dir covers everything in it
+func (r ignoreRule) matchesRelOrParent(rel string, isDir bool) bool {
+	for p := rel; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if r.matchesRel(p, isDir || p != rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultIgnorePatterns are the default --ignore (and package ignore) regexes
+func defaultIgnorePatterns() []string {
+	return []string{"README.*"}
+}
+
+// compileIgnorePatterns compiles --ignore (or a package's ignore) regexes, so a bad
+// pattern fails before walking
+func compileIgnorePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	ret := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --ignore pattern: %s: %w", pattern, err)
+		}
+		ret = append(ret, re)
+	}
+	return ret, nil
+}
+
+// compilePathGlobs compiles the globs passed to flag (--ignore-path or --only). They're written
+// like ignore file rules, but always match the path relative to the src dir (like
+// nvim/lazy-lock.json or dot-config/*/cache) and can't be negated with !
+func compilePathGlobs(flag string, patterns []string) ([]ignoreRule, error) {
+	ret := make([]ignoreRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		r, isRule, err := parseIgnoreRule("", flag, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !isRule || r.negate {
+			return nil, fmt.Errorf("invalid %s pattern (patterns can't be blank, comments, or start with !): %q", flag, pattern)
+		}
+		r.anchored = true
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// ignoreFiles reads the ignore files in a src dir as it's walked
+type ignoreFiles struct {
+	srcDir string
+	// rules caches rulesFor
+	rules map[string][]ignoreRule
+}
+
+func newIgnoreFiles(srcDir string) *ignoreFiles {
+	return &ignoreFiles{srcDir: srcDir, rules: make(map[string][]ignoreRule)}
+}
+
+// rulesFor returns the rules that apply to the entries of dir: those in the ignore files
+// from srcDir down to dir, in that order
+func (ig *ignoreFiles) rulesFor(dir string) ([]ignoreRule, error) {
+	if rules, exists := ig.rules[dir]; exists {
+		return rules, nil
+	}
+	var parentRules []ignoreRule
+	if dir != ig.srcDir && isUnderDir(dir, ig.srcDir) {
+		var err error
+		parentRules, err = ig.rulesFor(filepath.Dir(dir))
+		if err != nil {
+			return nil, err
+		}
+	}
+	own, err := readIgnoreFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	rules := slices.Concat(parentRules, own)
+	ig.rules[dir] = rules
+	return rules, nil
+}
+
+// match returns the rule that decides whether p is ignored: the last one that matches it,
+// so rules in deeper ignore files override rules above them. It returns nil if no rule matches.
+func (ig *ignoreFiles) match(p string, isDir bool) (*ignoreRule, error) {
+	rules, err := ig.rulesFor(filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range slices.Backward(rules) {
+		if r.matches(p, isDir) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+	"go.bbkane.com/warg/path"
+)
+
+// pathToImport is an existing file or dir at link to move to src (in a src dir), which it's then linked to
+type pathToImport = linkT
+
+// importPlan is what import does
+type importPlan struct {
+	// srcDir is the src dir (as passed) path is imported into
+	srcDir string
+	// dirsToCreate are the missing parents of path.src, from the top down. Their link is the dir
+	// in the link dir they mirror, whose permissions they get.
+	dirsToCreate []linkT
+	path         pathToImport
+}
+
+// importSrcDir returns the src dir whose link dir p is in. When p is in several link dirs,
+// the deepest one is used (like ~/.local/etc over ~). Src dirs sharing that link dir are ambiguous.
+func importSrcDir(p string, srcDirs []string, linkDir string, opts fileInfoOpts) (string, string, error) {
+	var chosen []string
+	chosenLinkDir := ""
+	for _, srcDir := range srcDirs {
+		ld, err := filepath.Abs(opts.linkDirFor(srcDir, linkDir))
+		if err != nil {
+			return "", "", fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+		}
+		if !isUnderDir(canonicalPath(p), canonicalDir(ld)) {
+			continue
+		}
+		switch {
+		case len(chosen) == 0 || len(ld) > len(chosenLinkDir):
+			chosen = []string{srcDir}
+			chosenLinkDir = ld
+		case ld == chosenLinkDir:
+			chosen = append(chosen, srcDir)
+		}
+	}
+	switch len(chosen) {
+	case 0:
+		return "", "", errors.New("path is not in the link dir of any src dir")
+	case 1:
+		return chosen[0], chosenLinkDir, nil
+	default:
+		return "", "", fmt.Errorf("path is in the link dir of several src dirs (%s). Pass the one to import it into with --src-dir or --package", strings.Join(chosen, ", "))
+	}
+}
+
+// planImport plans moving the file or dir at p (in a link dir) into the src dir it belongs
+// in and linking it. Its src name is found by reversing the src dir's rename rules (like
+// .tmux.conf -> dot-tmux.conf), so 'fling link' would create the same link.
+func planImport(p string, srcDirs []string, linkDir string, opts fileInfoOpts) (*importPlan, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get abs path for --path: %w", err)
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find path to import: %w", err)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil, fmt.Errorf("path is a symlink, so it's already linked or belongs elsewhere: %s", p)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("path is not a file or dir: %s", p)
+	}
+	if isUnderAnyDir(canonicalPath(p), srcDirs) {
+		return nil, fmt.Errorf("path is already in a src dir (through a dir link?): %s", p)
+	}
+
+	srcDir, ld, err := importSrcDir(p, srcDirs, linkDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, p)
+	}
+	absSrcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get abs path for srcDir: %w", err)
+	}
+	opts = opts.forSrcDir(srcDir)
+	renames := opts.renames()
+
+	relLink, err := filepath.Rel(canonicalDir(ld), canonicalPath(p))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get path relative to link dir: %w", err)
+	}
+	plan := importPlan{
+		srcDir:       srcDir,
+		dirsToCreate: nil,
+		path:         pathToImport{src: "", link: p},
+	}
+	src := absSrcDir
+	link := ld
+	names := strings.Split(relLink, string(filepath.Separator))
+	for i, name := range names {
+		srcName, err := renames.srcName(name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't find the src name for %s: %w", filepath.Join(link, name), err)
+		}
+		src = filepath.Join(src, srcName)
+		link = filepath.Join(link, name)
+		if i == len(names)-1 {
+			break
+		}
+		srcInfo, err := os.Stat(src)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			plan.dirsToCreate = append(plan.dirsToCreate, linkT{src: src, link: link})
+		case err != nil:
+			return nil, err
+		case !srcInfo.IsDir():
+			return nil, fmt.Errorf("src path's parent is not a dir: %s", src)
+		}
+	}
+	plan.path.src = src
+
+	_, err = os.Lstat(src)
+	if err == nil {
+		return nil, fmt.Errorf("src path already exists: %s. Use 'fling link --on-conflict adopt' to replace it with %s", src, p)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// an ignored src path wouldn't be linked (or unlinked) by later runs
+	relSrc, err := filepath.Rel(absSrcDir, src)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get path relative to src dir: %w", err)
+	}
+	rule, err := newIgnoreFiles(absSrcDir).match(src, info.IsDir())
+	if err != nil {
+		return nil, err
+	}
+	reason := opts.ignoreReason(relSrc, info.IsDir())
+	if rule != nil {
+		reason = ""
+		if !rule.negate {
+			reason = rule.String()
+		}
+	}
+	if reason != "" {
+		return nil, fmt.Errorf("src path would be ignored (%s): %s", reason, src)
+	}
+	return &plan, nil
+}
+
+// importOps returns the ops that make the changes planned in plan
+func importOps(plan *importPlan, linkStyle string) ([]op, error) {
+	var ops []op
+	for _, e := range plan.dirsToCreate {
+		info, err := os.Stat(e.link)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, newMkdirOp(e.src, info.Mode().Perm()))
+	}
+	target, err := symlinkTarget(plan.path.src, plan.path.link, linkStyle)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, newRenameOp(plan.path.link, plan.path.src), newCreateLinkOp(plan.path.link, target))
+	return ops, nil
+}
+
+func importCmd(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+	p := ctx.Flags["--path"].(path.Path).MustExpand()
+	linkStyle := ctx.Flags["--link-style"].(string)
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	r := newReporter(formatText, &color, "import")
+
+	plan, err := planImport(p, cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	{
+		f := bufio.NewWriter(os.Stdout)
+		if len(plan.dirsToCreate) > 0 {
+			fPrintHeader(f, &color, "Dirs to create in the src dir:")
+			fPrintLinkTs(f, &color, plan.dirsToCreate)
+			fmt.Fprintln(f)
+		}
+		fPrintHeader(f, &color, "Path to import (moved into the src dir, then linked):")
+		fPrintLinkTs(f, &color, []linkT{plan.path})
+		fmt.Fprintln(f)
+		f.Flush()
+	}
+
+	ops, err := importOps(plan, linkStyle)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	// check before asking so there's no point agreeing to an import that can't be applied
+	err = checkOps(ops)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	keepGoing, err := r.ask("Import path?", cf.ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecord(ctx.Context, "import", []string{plan.srcDir}, cf.linkDir, ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
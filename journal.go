@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+)
+
+// journalVersion is the version of the run files in the journal
+const journalVersion = 1
+
+// journalRun is the journal's record of one run of fling that changed the filesystem
+type journalRun struct {
+	Version int `json:"version"`
+	// ID is the run file's name without .json. It starts with Time, so IDs sort by time
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Argv    []string  `json:"argv"`
+	Command string    `json:"command"`
+	SrcDirs []string  `json:"srcDirs"`
+	LinkDir string    `json:"linkDir"`
+	// Undoes is the ID of the run an undo run undid
+	Undoes string `json:"undoes,omitempty"`
+	// Ops are the ops applied, in order
+	Ops []op `json:"ops"`
+}
+
+func journalDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal"), nil
+}
+
+// recordRun writes run to a new file in dir, setting its ID
+func recordRun(dir string, run *journalRun) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("couldn't create journal dir: %w", err)
+	}
+
+	// runs in the same second get a -<n> suffix
+	base := run.Time.Format("20060102T150405")
+	for n := 1; ; n++ {
+		run.ID = base
+		if n > 1 {
+			run.ID = fmt.Sprintf("%s-%d", base, n)
+		}
+		data, err := json.MarshalIndent(run, "", "  ")
+		if err != nil {
+			return fmt.Errorf("couldn't encode run: %w", err)
+		}
+		f, err := os.OpenFile(filepath.Join(dir, run.ID+".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't create run file: %w", err)
+		}
+		_, err = f.Write(append(data, '\n'))
+		closeErr := f.Close()
+		if err != nil || closeErr != nil {
+			return fmt.Errorf("couldn't write run file: %w", errors.Join(err, closeErr))
+		}
+		return nil
+	}
+}
+
+// readRuns returns the runs recorded in dir, oldest first
+func readRuns(dir string) ([]journalRun, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read journal dir: %w", err)
+	}
+	var runs []journalRun
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read run file: %w", err)
+		}
+		var run journalRun
+		err = json.Unmarshal(data, &run)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode run file: %s: %w", p, err)
+		}
+		if run.Version != journalVersion {
+			return nil, fmt.Errorf("unsupported run file version %d (this fling supports version %d): %s", run.Version, journalVersion, p)
+		}
+		runs = append(runs, run)
+	}
+	slices.SortFunc(runs, func(a, b journalRun) int {
+		if n := a.Time.Compare(b.Time); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return runs, nil
+}
+
+// applyAndRecord applies ops (see applyOps), records the run in the journal so
+// fling undo can reverse it, and records the links it created in the manifest. Not being
+// able to record the run only prints a warning, since the changes were already made.
+func applyAndRecord(ctx context.Context, command string, srcDirs []string, linkDir string, ops []op) error {
+	return applyAndRecordUndo(ctx, command, srcDirs, linkDir, ops, "")
+}
+
+// applyAndRecordUndo is applyAndRecord for undo runs, which record the ID of the run they undo
+func applyAndRecordUndo(ctx context.Context, command string, srcDirs []string, linkDir string, ops []op, undoes string) error {
+	tx, applied, err := applyOpsUncommitted(ctx, ops)
+	if err != nil {
+		return err
+	}
+	// record the run before committing, since the changes are made either way
+	defer tx.commitOrWarn()
+	run := journalRun{
+		Version: journalVersion,
+		ID:      "",
+		Time:    time.Now(),
+		Argv:    os.Args,
+		Command: command,
+		SrcDirs: srcDirs,
+		LinkDir: linkDir,
+		Undoes:  undoes,
+		Ops:     applied,
+	}
+	dir, err := journalDir()
+	if err == nil {
+		err = recordRun(dir, &run)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't record changes in the journal, so 'fling undo' can't reverse them: %v\n", err)
+		run.ID = ""
+	}
+	err = recordInManifest(applied, srcDirs, run.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't record links and dirs in the manifest, so 'fling unlink --manifest' may miss the links and unlink won't clean up the dirs: %v\n", err)
+	}
+	return nil
+}
+
+// undoOps returns the ops that reverse ops, along with the ops that can't be undone
+// (removed files, which are usually src files replaced when adopting)
+func undoOps(ops []op) ([]op, []op) {
+	var undo []op
+	var notUndoable []op
+	for _, o := range slices.Backward(ops) {
+		if o.Kind == opWriteFile {
+			// rendered templates are fling's own files, and the next link renders them again
+			continue
+		}
+		inverse, err := inverseOp(o)
+		if err != nil {
+			notUndoable = append(notUndoable, o)
+			continue
+		}
+		undo = append(undo, inverse)
+	}
+	return undo, notUndoable
+}
+
+// undoneBy returns the ID of the run that undid each run
+func undoneBy(runs []journalRun) map[string]string {
+	ret := make(map[string]string)
+	for _, r := range runs {
+		if r.Undoes != "" {
+			ret[r.Undoes] = r.ID
+		}
+	}
+	return ret
+}
+
+func history(ctx warg.CmdContext) error {
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	dir, err := journalDir()
+	if err != nil {
+		return err
+	}
+	runs, err := readRuns(dir)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Printf("No runs recorded in %s\n", dir)
+		return nil
+	}
+	undone := undoneBy(runs)
+
+	f := bufio.NewWriter(os.Stdout)
+	fPrintHeader(f, &color, "Runs (oldest first):")
+	for _, r := range runs {
+		fmt.Fprintf(f, "- %s: %s\n", color.Add(color.Bold, "id"), r.ID)
+		fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "time"), r.Time.Format(time.RFC3339))
+		fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "argv"), strings.Join(r.Argv, " "))
+		if r.LinkDir != "" {
+			fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "linkDir"), r.LinkDir)
+		}
+		for _, s := range r.SrcDirs {
+			fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "srcDir"), s)
+		}
+		if r.Undoes != "" {
+			fmt.Fprintf(f, "  %s: %s\n", color.Add(color.Bold, "undoes"), r.Undoes)
+		}
+		fmt.Fprintf(f, "  %s: %d\n", color.Add(color.Bold, "ops"), len(r.Ops))
+		if by, exists := undone[r.ID]; exists {
+			fmt.Fprintf(f, "  %s\n", color.Add(color.FgYellow, "undone by "+by))
+		}
+	}
+	return f.Flush()
+}
+
+func undoCmd(ctx warg.CmdContext) error {
+	ask := ctx.Flags["--ask"].(string)
+	runID := ""
+	if runIDF, exists := ctx.Flags["--run-id"]; exists {
+		runID = runIDF.(string)
+	}
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	dir, err := journalDir()
+	if err != nil {
+		return err
+	}
+	runs, err := readRuns(dir)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("no runs recorded in %s", dir)
+	}
+	// default to the most recent run
+	i := len(runs) - 1
+	if runID != "" {
+		i = slices.IndexFunc(runs, func(r journalRun) bool { return r.ID == runID })
+		if i == -1 {
+			return fmt.Errorf("run not found in %s: %s", dir, runID)
+		}
+	}
+	run := runs[i]
+	if by, exists := undoneBy(runs)[run.ID]; exists {
+		return fmt.Errorf("run %s was already undone by run %s", run.ID, by)
+	}
+
+	ops, notUndoable := undoOps(run.Ops)
+
+	r := newReporter(formatText, &color, "undo")
+	{
+		f := bufio.NewWriter(os.Stdout)
+		fmt.Fprintf(f, "Undoing run %s: %s\n\n", run.ID, strings.Join(run.Argv, " "))
+		if len(notUndoable) > 0 {
+			fPrintErrorHeader(f, &color, "Can't undo (restore these from version control or a backup):")
+			fPrintOps(f, &color, notUndoable)
+			fmt.Fprintln(f)
+		}
+		if len(ops) > 0 {
+			fPrintHeader(f, &color, "Operations:")
+			fPrintOps(f, &color, ops)
+			fmt.Fprintln(f)
+		}
+		f.Flush()
+	}
+
+	if len(ops) == 0 {
+		return r.finish(outcomeNothingToDo, nil)
+	}
+
+	// check before asking so there's no point agreeing to an undo that can't be applied
+	err = checkOps(ops)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	keepGoing, err := r.ask("Undo run?", ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecordUndo(ctx.Context, "undo", run.SrcDirs, run.LinkDir, ops, run.ID)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"cmp"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
 	"slices"
 	"strings"
+	"time"
 
 	"github.com/karrick/godirwalk"
 	"go.bbkane.com/gocolor"
@@ -62,6 +66,15 @@ func (t linkT) ColorString(color *gocolor.Color) string {
 	)
 }
 
+// compareLinks sorts linkTs by link, then src
+// https://pkg.go.dev/slices#example-SortFunc-MultiField
+func compareLinks(a, b linkT) int {
+	if n := cmp.Compare(a.link, b.link); n != 0 {
+		return n
+	}
+	return cmp.Compare(a.src, b.src)
+}
+
 func fPrintLinkTs(f *bufio.Writer, color *gocolor.Color, lTs []linkT) {
 	for _, e := range lTs {
 		fmt.Fprintf(f, "%s\n", e.ColorString(color))
@@ -78,6 +91,79 @@ type dirLinkToCreate = linkT
 type existingFileLink = linkT
 type existingDirLink = linkT
 
+// pathToAdopt is an existing file/dir in the way of a link. Adopting moves it
+// from link into src (replacing src) and then links src.
+type pathToAdopt = linkT
+
+// pathToBackup is an existing file or foreign symlink in the way of a link. Backing
+// it up renames link to backupPath(link, ...) and then links src.
+type pathToBackup = linkT
+
+// dirToCreate is a real dir to create at link (instead of linking it) with the same permissions as src
+type dirToCreate = linkT
+
+// existingDir is a real dir at link that the src dir at src is walked into
+type existingDir = linkT
+
+// emptyDirToDelete is a dir at link, mirroring src, that will be empty once links are deleted
+type emptyDirToDelete = linkT
+
+// dirToUnfold is a dir symlink from link to src (in one src dir) that another src dir
+// also needs to put links into. Unfolding replaces the link with a real dir and links
+// src's children individually, like GNU Stow's tree unfolding.
+type dirToUnfold = linkT
+
+// dirToRefold is a real dir at link whose remaining entries are all links to the
+// entries of the single dir src. Refolding replaces it with a link to src.
+type dirToRefold = linkT
+
+// identicalFileToReplace is a regular file in the way of a link with exactly the
+// same content as src, so it's safe to replace with a link.
+type identicalFileToReplace = linkT
+
+// orphanedLink is a symlink at link into a src dir whose target src no longer exists,
+// usually because it was deleted or renamed.
+type orphanedLink = linkT
+
+// backupInfix is part of every backup file name. Backups are named
+// <link><backupInfix><timestamp>, and the manifest records them so
+// unlink --restore-backups only restores backups fling made.
+const backupInfix = ".fling-bak."
+
+// backupPath returns the path to back link up to at t. Backups in the same second
+// get a -<n> suffix, like run IDs, so a backup never replaces an earlier one.
+func backupPath(link string, t time.Time) (string, error) {
+	base := link + backupInfix + t.Format("20060102T150405")
+	for n := 1; ; n++ {
+		p := base
+		if n > 1 {
+			p = fmt.Sprintf("%s-%d", base, n)
+		}
+		_, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("couldn't check backup path: %w", err)
+		}
+	}
+}
+
+type backupToRestore struct {
+	backup string
+	link   string
+}
+
+func (t backupToRestore) ColorString(color *gocolor.Color) string {
+	return fmt.Sprintf(
+		"- %s: %s\n  %s: %s",
+		color.Add(color.Bold, "backup"),
+		t.backup,
+		color.Add(color.Bold, "link"),
+		t.link,
+	)
+}
+
 type pathErr struct {
 	path string
 	err  error
@@ -111,24 +197,47 @@ func (t pathsErr) ColorString(color *gocolor.Color) string {
 	)
 }
 
-type ignoredPath string
+// ignoredPath is a src path that isn't linked, and why
+type ignoredPath struct {
+	path string
+	// reason is the pattern (or the ignore file and line) that matched path,
+	// or why fling ignores it by itself
+	reason string
+}
 
 func (t ignoredPath) ColorString(color *gocolor.Color) string {
 	return fmt.Sprintf(
-		"- %s: %s",
+		"- %s: %s\n  %s: %s",
 		color.Add(color.Bold, "path"),
-		string(t),
+		t.path,
+		color.Add(color.Bold, "reason"),
+		t.reason,
 	)
 }
 
+// compareIgnoredPaths sorts ignoredPaths by path
+func compareIgnoredPaths(a, b ignoredPath) int {
+	return cmp.Compare(a.path, b.path)
+}
+
 type fileInfo struct {
+	chosenAlternates  []chosenAlternate
 	dirLinksToCreate  []dirLinkToCreate
+	dirsToCreate      []dirToCreate
+	dirsToUnfold      []dirToUnfold
 	existingDirLinks  []existingDirLink
+	existingDirs      []existingDir
 	existingFileLinks []existingFileLink
 	fileLinksToCreate []fileLinkToCreate
+	identicalFiles    []identicalFileToReplace
 	ignoredPaths      []ignoredPath
+	orphanedLinks     []orphanedLink
+	outOfScope        []linkT
 	pathErrs          []pathErr
 	pathsErrs         []pathsErr
+	pathsToAdopt      []pathToAdopt
+	pathsToBackup     []pathToBackup
+	templatesToRender []templateToRender
 }
 
 func fPrintHeader(f *bufio.Writer, color *gocolor.Color, header string) {
@@ -145,17 +254,261 @@ func fPrintErrorHeader(f *bufio.Writer, color *gocolor.Color, header string) {
 	)
 }
 
-// replacePrefix return (s with prefixed replaced, true)
-// if the string has the prefix, otherwise (s, false)
-func replacePrefix(s string, prefix string, replacement string) (string, bool) {
-	if strings.HasPrefix(s, prefix) {
-		s = replacement + strings.TrimPrefix(s, prefix)
-		return s, true
+// filesIdentical reports whether the regular files at a and b have the same bytes
+func filesIdentical(a string, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+	aContent, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bContent, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aContent, bContent), nil
+}
+
+// replaceWithLink atomically replaces the file at link with a symlink to target
+// by creating the symlink under a temporary name and renaming it over link.
+func replaceWithLink(target string, link string) error {
+	tmp := filepath.Join(filepath.Dir(link), "."+filepath.Base(link)+".fling-tmp")
+	err := os.Symlink(target, tmp)
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary link: %w", err)
+	}
+	err = os.Rename(tmp, link)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("couldn't replace %s with link: %w", link, err)
+	}
+	return nil
+}
+
+// isUnderDir reports whether p is strictly inside dir. Both should be canonical.
+func isUnderDir(p string, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// isUnderAnyDir reports whether p is strictly inside any of dirs. p should be canonical.
+func isUnderAnyDir(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if isUnderDir(p, canonicalDir(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalDir returns dir with all symlinks resolved. If that's not possible (for
+// example, it doesn't exist yet), its closest parent that can be resolved is, so dirs
+// that will be created under a symlinked dir still get its physical path.
+func canonicalDir(dir string) string {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		return resolved
+	}
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return dir
+	}
+	return filepath.Join(canonicalDir(parent), filepath.Base(dir))
+}
+
+// canonicalPath resolves symlinks in the parent directories of p, but not p itself,
+// so two paths naming the same directory entry compare equal
+func canonicalPath(p string) string {
+	return filepath.Join(canonicalDir(filepath.Dir(p)), filepath.Base(p))
+}
+
+// resolveLinkTarget returns the absolute path a symlink at linkPath with the
+// given target points to. Relative targets are resolved against the physical
+// directory containing linkPath, just like the OS does.
+func resolveLinkTarget(linkPath string, target string) string {
+	if filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+	return filepath.Join(canonicalDir(filepath.Dir(linkPath)), target)
+}
+
+// linkPointsTo reports whether the symlink target read from linkPath refers to the same
+// directory entry as srcPath. Absolute, relative (GNU Stow style), and paths through
+// symlinked parent directories are all compared by their canonical paths.
+func linkPointsTo(linkPath string, target string, srcPath string) bool {
+	return canonicalPath(resolveLinkTarget(linkPath, target)) == canonicalPath(srcPath)
+}
+
+// symlinkTarget returns the target to write into a symlink at link pointing to src.
+// linkStyle "relative" makes the target relative to link's directory (like GNU Stow).
+func symlinkTarget(src string, link string, linkStyle string) (string, error) {
+	switch linkStyle {
+	case "absolute":
+		return src, nil
+	case "relative":
+		// the OS resolves relative targets against the physical dir containing link
+		target, err := filepath.Rel(canonicalDir(filepath.Dir(link)), canonicalPath(src))
+		if err != nil {
+			return "", fmt.Errorf("couldn't get relative link target: %s -> %s: %w", link, src, err)
+		}
+		return target, nil
+	default:
+		return "", fmt.Errorf("link style not valid: %s", linkStyle)
+	}
+}
+
+// noFoldMarker is the name of a file that, when present in a src dir, makes that
+// dir be created as a real dir instead of being linked
+const noFoldMarker = ".fling-nofold"
+
+// isNoFoldDir reports whether the src dir at srcPath should be a real dir at linkPath instead of a dir link
+func isNoFoldDir(opts fileInfoOpts, srcPath string, linkPath string, linkDir string) bool {
+	if opts.noFolding {
+		return true
+	}
+	rel, err := filepath.Rel(linkDir, linkPath)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, p := range opts.noFoldPaths {
+		p = filepath.ToSlash(filepath.Clean(p))
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			return true
+		}
+	}
+	_, err = os.Lstat(filepath.Join(srcPath, noFoldMarker))
+	return err == nil
+}
+
+// fileInfoOpts control how buildFileInfo maps and classifies paths
+type fileInfoOpts struct {
+	// ignorePatterns are regexes matched against the name of each path in the src dir
+	ignorePatterns []*regexp.Regexp
+	// ignorePaths are globs matched against the path relative to the src dir (see compilePathGlobs)
+	ignorePaths []ignoreRule
+	// isDotfiles maps names starting with "dot-" to names starting with "."
+	isDotfiles bool
+	// renameRules rename each path component, in order, after isDotfiles (see renames)
+	renameRules []renameRule
+	// srcDirOpts overrides the link dir, ignorePatterns, isDotfiles, and renameRules for some src dirs
+	// (see linkDirFor and forSrcDir)
+	srcDirOpts map[string]srcDirOpts
+	// onConflict controls what happens when a file or dir is in the way of a link:
+	// "error" reports it, "adopt" plans to move it into the src dir (see pathToAdopt),
+	// and "backup" plans to rename it out of the way (see pathToBackup).
+	onConflict string
+	// machine chooses between alternate src paths (see chooseAlternate)
+	machine machineFacts
+	// templates renders src files ending in templateExt. When nil, they're linked like other files
+	templates *templateOpts
+	// scope limits the plan to some paths. When nil, everything is in scope.
+	scope *scope
+	// noFolding never links dirs. Instead, it creates real dirs in the link dir and links files in them.
+	noFolding bool
+	// noFoldPaths are paths relative to the link dir (and their parents) that are always
+	// created as real dirs, like noFolding does for every dir. Src dirs containing a
+	// noFoldMarker file are treated the same way.
+	noFoldPaths []string
+	// unfold allows replacing a dir link into one src dir with a real dir when another
+	// src dir also has children for it (see dirToUnfold). When false, such links
+	// are left to the src dir that owns them.
+	unfold bool
+}
+
+// srcDirOpts are the settings a src dir can have for itself (from a src:linkdir pair
+// or its package in the config file)
+type srcDirOpts struct {
+	// linkDir is the absolute dir to link srcDir into
+	linkDir        string
+	ignorePatterns []*regexp.Regexp
+	isDotfiles     bool
+	renameRules    []renameRule
+}
+
+// linkDirFor returns the link dir srcDir is linked into: its own, or linkDir
+func (opts fileInfoOpts) linkDirFor(srcDir string, linkDir string) string {
+	if so, exists := opts.srcDirOpts[srcDir]; exists {
+		return so.linkDir
+	}
+	return linkDir
+}
+
+// linkDirOf returns the link dir of the src dir src is in (see linkDirFor),
+// so links found in the link dirs can be cleaned up relative to the right one
+func (opts fileInfoOpts) linkDirOf(src string, linkDir string) string {
+	for _, srcDir := range slices.Sorted(maps.Keys(opts.srcDirOpts)) {
+		if isUnderDir(canonicalPath(src), canonicalDir(srcDir)) {
+			return opts.srcDirOpts[srcDir].linkDir
+		}
+	}
+	return linkDir
+}
+
+// linkDirs returns the link dirs srcDirs are linked into, without duplicates
+func (opts fileInfoOpts) linkDirs(srcDirs []string, linkDir string) []string {
+	var ret []string
+	for _, srcDir := range srcDirs {
+		ld := opts.linkDirFor(srcDir, linkDir)
+		if !slices.Contains(ret, ld) {
+			ret = append(ret, ld)
+		}
+	}
+	return ret
+}
+
+// ignoreReason returns the ignore regex or --ignore-path glob that matches relPath (relative
+// to the src dir), or "" if none do
+func (opts fileInfoOpts) ignoreReason(relPath string, isDir bool) string {
+	for _, re := range opts.ignorePatterns {
+		if re.MatchString(filepath.Base(relPath)) {
+			return "ignore pattern " + re.String()
+		}
+	}
+	for _, r := range opts.ignorePaths {
+		if r.matchesRel(relPath, isDir) {
+			return r.String()
+		}
+	}
+	return ""
+}
+
+// forSrcDir returns opts with srcDir's own settings, if it has any
+func (opts fileInfoOpts) forSrcDir(srcDir string) fileInfoOpts {
+	if so, exists := opts.srcDirOpts[srcDir]; exists {
+		opts.ignorePatterns = so.ignorePatterns
+		opts.isDotfiles = so.isDotfiles
+		opts.renameRules = so.renameRules
+	}
+	return opts
+}
+
+// renames returns the rename rules for src path components: isDotfiles' rule, then renameRules
+func (opts fileInfoOpts) renames() renameRules {
+	if opts.isDotfiles {
+		return slices.Concat([]renameRule{dotfilesRule()}, opts.renameRules)
 	}
-	return s, false
+	return opts.renameRules
 }
 
-func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDotfiles bool) (*fileInfo, error) {
+// buildFileInfo walks srcDir and classifies each path by what needs to happen in linkDir.
+// srcDirs are all the src dirs of this run, so dir links into other src dirs can be
+// proposed for unfolding. Paths in unfoldLinks (and their children) are planned as if
+// those dir links had already been unfolded.
+func buildFileInfo(srcDir string, linkDir string, opts fileInfoOpts, srcDirs []string, unfoldLinks map[string]bool) (*fileInfo, error) {
 	linkDir, err := filepath.Abs(linkDir)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
@@ -167,15 +520,30 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 	}
 
 	fi := fileInfo{
+		chosenAlternates:  nil,
 		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
 		fileLinksToCreate: nil,
 		existingDirLinks:  nil,
+		existingDirs:      nil,
 		existingFileLinks: nil,
+		identicalFiles:    nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
 		pathErrs:          nil,
 		pathsErrs:         nil,
 		ignoredPaths:      nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
 	}
-	linkPathReplacements := make(map[string]string)
+	// src dir -> its link path, so children are linked in their parent's (renamed) link path
+	linkPaths := map[string]string{srcDir: linkDir}
+	renames := opts.renames()
+	// dir -> names of its entries, for choosing alternates
+	dirNames := make(map[string][]string)
+	ignores := newIgnoreFiles(srcDir)
 
 	err = godirwalk.Walk(srcDir, &godirwalk.Options{
 
@@ -185,21 +553,15 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 				return nil // skip the first entry (toDir)
 			}
 
-			// ignore srcPath name regexes
-			for _, pattern := range ignorePatterns {
-				// NOTE: can compile these regexes for speed
-				match, err := regexp.Match(pattern, []byte(srcDe.Name()))
-				if err != nil {
-					err = fmt.Errorf("invalid --ignore pattern: %s: %w", pattern, err)
-					return err // Exit immediately on a bad pattern.
-				}
-				if match {
-					fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath(srcPath))
-					return godirwalk.SkipThis
-				}
+			if srcDe.Name() == noFoldMarker {
+				fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath{path: srcPath, reason: "no-fold marker file"})
+				return nil
+			}
+			if srcDe.Name() == ignoreFileName {
+				fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath{path: srcPath, reason: "ignore file"})
+				return nil
 			}
 
-			// determine linkPath
 			relPath, err := filepath.Rel(srcDir, srcPath)
 			if err != nil {
 				p := pathErr{
@@ -209,29 +571,83 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 				fi.pathErrs = append(fi.pathErrs, p)
 				return godirwalk.SkipThis
 			}
-			linkPath := filepath.Join(linkDir, relPath)
-
-			// Now that we have a linkPath, "correct" it if necessary by replacing dot- with .
-			// because we're not changing srcPath, "errors" will keep popping up, so keep a list of
-			// replacements around to "correct" parent directories
-			if isDotfiles {
-				// replace previous elements of the path from parents we've already seen
-				// fmt.Printf("linkPathReplacements: %#v\n", linkPathReplacements)
-				for path, replacement := range linkPathReplacements {
-					// fmt.Printf(":%s: %s -> %s\n", linkPath, path, replacement)
-					linkPath, _ = replacePrefix(linkPath, path, replacement)
+
+			// ignore files decide first, so they can re-include what ignore patterns ignore
+			rule, err := ignores.match(srcPath, srcDe.IsDir())
+			if err != nil {
+				return err // Exit immediately on a bad ignore file.
+			}
+			if rule != nil && !rule.negate {
+				fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath{path: srcPath, reason: rule.String()})
+				return godirwalk.SkipThis
+			}
+
+			// ignore srcPath name regexes and relative path globs, unless an ignore file re-included it
+			if rule == nil {
+				if reason := opts.ignoreReason(relPath, srcDe.IsDir()); reason != "" {
+					fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath{path: srcPath, reason: reason})
+					return godirwalk.SkipThis
+				}
+			}
+
+			// only link the alternate chosen for this machine
+			parentNames, exists := dirNames[filepath.Dir(srcPath)]
+			if !exists {
+				entries, err := os.ReadDir(filepath.Dir(srcPath))
+				if err != nil {
+					return fmt.Errorf("couldn't read dir to check for alternates: %w", err)
+				}
+				for _, e := range entries {
+					parentNames = append(parentNames, e.Name())
+				}
+				dirNames[filepath.Dir(srcPath)] = parentNames
+			}
+			altBase, _, _ := strings.Cut(srcDe.Name(), alternateSep)
+			altReason := ""
+			if hasAlternates(altBase, parentNames) {
+				chosen, reason, err := chooseAlternate(altBase, parentNames, opts.machine)
+				if err != nil {
+					p := pathErr{
+						path: srcPath,
+						err:  err,
+					}
+					fi.pathErrs = append(fi.pathErrs, p)
+					return godirwalk.SkipThis
+				}
+				if chosen != srcDe.Name() {
+					fi.ignoredPaths = append(fi.ignoredPaths, ignoredPath{path: srcPath, reason: "not the alternate chosen for this machine"})
+					return godirwalk.SkipThis
 				}
+				altReason = reason
+			}
 
-				linkPathName := filepath.Base(linkPath)
-				linkPathDir := filepath.Dir(linkPath)
-				// replace the last element of the path if necessary
-				linkPathNameNew, replaced := replacePrefix(linkPathName, "dot-", ".")
-				if replaced {
-					// fmt.Printf("replaced: %s -> %s\n", linkPathName, linkPathNameNew)
-					linkPathNew := filepath.Join(linkPathDir, linkPathNameNew)
-					linkPathReplacements[linkPath] = linkPathNew
-					linkPath = linkPathNew
+			// determine linkPath: the parent's link path and this name without an alternate's
+			// ##suffix or a template's extension, renamed by the rename rules
+			linkPathName := altBase
+			isTemplate := opts.templates != nil && !srcDe.IsDir() && strings.HasSuffix(altBase, templateExt) && altBase != templateExt
+			if isTemplate {
+				linkPathName = strings.TrimSuffix(linkPathName, templateExt)
+			}
+			linkPathName, err = renames.linkName(linkPathName)
+			if err != nil {
+				p := pathErr{
+					path: srcPath,
+					err:  err,
 				}
+				fi.pathErrs = append(fi.pathErrs, p)
+				return godirwalk.SkipThis
+			}
+			linkPath := filepath.Join(linkPaths[filepath.Dir(srcPath)], linkPathName)
+			if srcDe.IsDir() {
+				linkPaths[srcPath] = linkPath
+			}
+
+			if altReason != "" {
+				fi.chosenAlternates = append(fi.chosenAlternates, chosenAlternate{
+					src:    srcPath,
+					link:   linkPath,
+					reason: altReason,
+				})
 			}
 
 			if srcDe.IsSymlink() {
@@ -255,8 +671,29 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 				return godirwalk.SkipThis
 			}
 
+			if unfoldLinks[linkPath] && srcDe.IsDir() {
+				// this dir link will be replaced by a real dir, so continue with children
+				return nil
+			}
+
 			linkPathLstatRes, linkPathLstatErr := os.Lstat(linkPath)
+			if isUnderUnfoldLink(linkPath, linkDir, unfoldLinks) {
+				// the dir containing linkPath will be a new, empty, dir after unfolding
+				linkPathLstatRes, linkPathLstatErr = nil, fs.ErrNotExist
+			}
+			if isTemplate {
+				planTemplateLink(&fi, opts, srcPath, linkPath, linkPathLstatRes, linkPathLstatErr)
+				return godirwalk.SkipThis
+			}
 			if errors.Is(linkPathLstatErr, fs.ErrNotExist) {
+				if srcDe.IsDir() && isNoFoldDir(opts, srcPath, linkPath, linkDir) {
+					dtc := dirToCreate{
+						src:  srcPath,
+						link: linkPath,
+					}
+					fi.dirsToCreate = append(fi.dirsToCreate, dtc)
+					return nil // continue with children
+				}
 				if srcDe.IsDir() {
 					ltc := dirLinkToCreate{
 						src:  srcPath,
@@ -298,7 +735,7 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 			// and it's a symlink to a directory, the directory bit will also be set
 			// so it's easier to just keep this check in both branches
 			if linkPathLstatRes.Mode()&fs.ModeSymlink != 0 {
-				// it's a symlink, get target. We're already expecting an absolute link
+				// it's a symlink, get target. It might be absolute or relative to linkPath's dir
 				linkPathSymlinkTarget, err := os.Readlink(linkPath)
 				if err != nil {
 					// fmt.Printf("readlink Err: %s: %s\n", linkPath, err)
@@ -309,7 +746,7 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 					fi.pathErrs = append(fi.pathErrs, p)
 					return godirwalk.SkipThis
 				}
-				if linkPathSymlinkTarget == srcPath {
+				if linkPointsTo(linkPath, linkPathSymlinkTarget, srcPath) {
 					// fmt.Printf("linkPath already points to target. No need to do more")
 
 					if srcDe.IsDir() {
@@ -328,6 +765,29 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 
 					return godirwalk.SkipThis
 				} else {
+					if srcDe.IsDir() {
+						resolved := canonicalPath(resolveLinkTarget(linkPath, linkPathSymlinkTarget))
+						resolvedInfo, err := os.Stat(resolved)
+						if err == nil && resolvedInfo.IsDir() && isUnderAnyDir(resolved, srcDirs) {
+							if opts.unfold {
+								dtu := dirToUnfold{
+									src:  resolved,
+									link: linkPath,
+								}
+								fi.dirsToUnfold = append(fi.dirsToUnfold, dtu)
+							}
+							// otherwise it's a link owned by another src dir
+							return godirwalk.SkipThis
+						}
+					}
+					if opts.onConflict == "backup" {
+						ptb := pathToBackup{
+							src:  srcPath,
+							link: linkPath,
+						}
+						fi.pathsToBackup = append(fi.pathsToBackup, ptb)
+						return godirwalk.SkipThis
+					}
 					// fmt.Printf("linkPath unrecognized symlink: %s -> %s , not %s\n", linkPath, linkPathSymlinkTarget, srcPath)
 					pse := pathsErr{
 						src:  srcPath,
@@ -341,10 +801,23 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 
 			if linkPathLstatRes.IsDir() {
 				if srcDe.IsDir() {
-					// I think this is ok and we don't need to report it :)
+					// I think this is ok and we don't need to report it as a link :)
 					// fmt.Printf("linkPath is already an existing dir. Continuing with children: %s\n", linkPath)
+					ed := existingDir{
+						src:  srcPath,
+						link: linkPath,
+					}
+					fi.existingDirs = append(fi.existingDirs, ed)
 					return nil
 				} else {
+					if opts.onConflict == "adopt" {
+						pta := pathToAdopt{
+							src:  srcPath,
+							link: linkPath,
+						}
+						fi.pathsToAdopt = append(fi.pathsToAdopt, pta)
+						return nil
+					}
 					// fmt.Printf("ERROR: linkPath is existing dir and srcPath is file: linkpath: %s , srcPath: %s\n", linkPath, srcPath)
 					pse := pathsErr{
 						src:  srcPath,
@@ -357,6 +830,41 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 
 			}
 			// linkpath is an existing normal file
+			if !srcDe.IsDir() {
+				identical, err := filesIdentical(srcPath, linkPath)
+				if err != nil {
+					p := pathErr{
+						path: linkPath,
+						err:  fmt.Errorf("couldn't compare with src: %w", err),
+					}
+					fi.pathErrs = append(fi.pathErrs, p)
+					return godirwalk.SkipThis
+				}
+				if identical {
+					iftr := identicalFileToReplace{
+						src:  srcPath,
+						link: linkPath,
+					}
+					fi.identicalFiles = append(fi.identicalFiles, iftr)
+					return godirwalk.SkipThis
+				}
+			}
+			if opts.onConflict == "adopt" && !srcDe.IsDir() {
+				pta := pathToAdopt{
+					src:  srcPath,
+					link: linkPath,
+				}
+				fi.pathsToAdopt = append(fi.pathsToAdopt, pta)
+				return godirwalk.SkipThis
+			}
+			if opts.onConflict == "backup" {
+				ptb := pathToBackup{
+					src:  srcPath,
+					link: linkPath,
+				}
+				fi.pathsToBackup = append(fi.pathsToBackup, ptb)
+				return godirwalk.SkipThis
+			}
 			p := pathErr{
 				path: linkPath,
 				err:  errors.New("linkPath is already an existing file"),
@@ -379,19 +887,18 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 	// sort all fields so all traversals of the same directory
 	// produce the same struct - needed for tests
 
-	// https://pkg.go.dev/slices#example-SortFunc-MultiField
-	compareLinks := func(a, b linkT) int {
-		if n := cmp.Compare(a.link, b.link); n != 0 {
-			return n
-		}
-		return cmp.Compare(a.src, b.src)
-	}
-
 	slices.SortFunc(fi.dirLinksToCreate, compareLinks)
+	slices.SortFunc(fi.dirsToCreate, compareLinks)
+	slices.SortFunc(fi.dirsToUnfold, compareLinks)
 	slices.SortFunc(fi.existingDirLinks, compareLinks)
+	slices.SortFunc(fi.existingDirs, compareLinks)
 	slices.SortFunc(fi.existingFileLinks, compareLinks)
 	slices.SortFunc(fi.fileLinksToCreate, compareLinks)
-	slices.Sort(fi.ignoredPaths)
+	slices.SortFunc(fi.identicalFiles, compareLinks)
+	slices.SortFunc(fi.pathsToAdopt, compareLinks)
+	slices.SortFunc(fi.pathsToBackup, compareLinks)
+	slices.SortFunc(fi.templatesToRender, compareTemplates)
+	slices.SortFunc(fi.ignoredPaths, compareIgnoredPaths)
 	slices.SortFunc(fi.pathErrs, func(a, b pathErr) int {
 		if n := cmp.Compare(a.path, b.path); n != 0 {
 			return n
@@ -412,113 +919,464 @@ func buildFileInfo(srcDir string, linkDir string, ignorePatterns []string, isDot
 
 }
 
-// buildCombinedFileInfo runs buildFileInfo for each srcDir and merges the results.
+// isUnderUnfoldLink reports whether any parent dir of linkPath (up to linkDir) is in unfoldLinks
+func isUnderUnfoldLink(linkPath string, linkDir string, unfoldLinks map[string]bool) bool {
+	for dir := filepath.Dir(linkPath); isUnderDir(dir, linkDir); dir = filepath.Dir(dir) {
+		if unfoldLinks[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFileInfo runs buildFileInfo for each srcDir and merges the results.
 // It detects link path conflicts between src dirs — where two different src dirs would
 // produce the same link path — and records them as pathsErrs rather than adding them
 // to the links-to-create lists. All other errors from individual src dirs are also merged.
-func buildCombinedFileInfo(srcDirs []string, linkDir string, ignorePatterns []string, isDotfiles bool) (*fileInfo, error) {
+func mergeFileInfo(srcDirs []string, linkDir string, opts fileInfoOpts, unfoldLinks map[string]bool) (*fileInfo, error) {
 	combined := &fileInfo{
+		chosenAlternates:  nil,
 		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
 		existingDirLinks:  nil,
+		existingDirs:      nil,
 		existingFileLinks: nil,
 		fileLinksToCreate: nil,
+		identicalFiles:    nil,
 		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
 		pathErrs:          nil,
 		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
 	}
 
-	// linkPath -> []linkT for all "to create" items, for cross-src-dir conflict detection
-	allLinksToCreate := make(map[string][]linkT)
-	isDirLink := make(map[string]bool)
+	// plannedLink is a link to create and the combined list it belongs in if there's no conflict
+	type plannedLink struct {
+		lt   linkT
+		dest *[]linkT
+	}
+
+	// linkPath -> []plannedLink for all "to create" items, for cross-src-dir conflict detection
+	allLinksToCreate := make(map[string][]plannedLink)
+	addPlanned := func(ltcs []linkT, dest *[]linkT) {
+		for _, ltc := range ltcs {
+			allLinksToCreate[ltc.link] = append(allLinksToCreate[ltc.link], plannedLink{lt: ltc, dest: dest})
+		}
+	}
+
+	// several src dirs can need the same real dir, so only create it once
+	dirsToCreate := make(map[string]dirToCreate)
+	// and several src dirs can be walked into the same existing dir
+	existingDirs := make(map[string]bool)
 
 	for _, srcDir := range srcDirs {
-		fi, err := buildFileInfo(srcDir, linkDir, ignorePatterns, isDotfiles)
+		fi, err := buildFileInfo(srcDir, opts.linkDirFor(srcDir, linkDir), opts.forSrcDir(srcDir), srcDirs, unfoldLinks)
 		if err != nil {
 			return nil, err
 		}
 
+		for _, ed := range fi.existingDirs {
+			if !existingDirs[ed.link] {
+				existingDirs[ed.link] = true
+				combined.existingDirs = append(combined.existingDirs, ed)
+			}
+		}
+		for _, dtc := range fi.dirsToCreate {
+			if _, exists := dirsToCreate[dtc.link]; !exists {
+				dirsToCreate[dtc.link] = dtc
+				combined.dirsToCreate = append(combined.dirsToCreate, dtc)
+			}
+		}
+
+		combined.chosenAlternates = append(combined.chosenAlternates, fi.chosenAlternates...)
+		combined.dirsToUnfold = append(combined.dirsToUnfold, fi.dirsToUnfold...)
 		combined.ignoredPaths = append(combined.ignoredPaths, fi.ignoredPaths...)
 		combined.pathErrs = append(combined.pathErrs, fi.pathErrs...)
 		combined.pathsErrs = append(combined.pathsErrs, fi.pathsErrs...)
 		combined.existingDirLinks = append(combined.existingDirLinks, fi.existingDirLinks...)
 		combined.existingFileLinks = append(combined.existingFileLinks, fi.existingFileLinks...)
+		combined.templatesToRender = append(combined.templatesToRender, fi.templatesToRender...)
 
-		for _, ltc := range fi.dirLinksToCreate {
-			allLinksToCreate[ltc.link] = append(allLinksToCreate[ltc.link], ltc)
-			isDirLink[ltc.link] = true
-		}
-		for _, ltc := range fi.fileLinksToCreate {
-			allLinksToCreate[ltc.link] = append(allLinksToCreate[ltc.link], ltc)
-		}
+		addPlanned(fi.dirLinksToCreate, &combined.dirLinksToCreate)
+		addPlanned(fi.fileLinksToCreate, &combined.fileLinksToCreate)
+		addPlanned(fi.identicalFiles, &combined.identicalFiles)
+		addPlanned(fi.pathsToAdopt, &combined.pathsToAdopt)
+		addPlanned(fi.pathsToBackup, &combined.pathsToBackup)
 	}
 
-	for linkPath, ltcs := range allLinksToCreate {
-		if len(ltcs) > 1 {
-			for _, ltc := range ltcs {
+	for linkPath, pls := range allLinksToCreate {
+		if dtc, exists := dirsToCreate[linkPath]; exists {
+			for _, pl := range pls {
 				combined.pathsErrs = append(combined.pathsErrs, pathsErr{
-					src:  ltc.src,
-					link: ltc.link,
+					src:  pl.lt.src,
+					link: pl.lt.link,
+					err:  fmt.Errorf("link path conflict with dir to create for src: %s", dtc.src),
+				})
+			}
+		} else if len(pls) > 1 {
+			for _, pl := range pls {
+				combined.pathsErrs = append(combined.pathsErrs, pathsErr{
+					src:  pl.lt.src,
+					link: pl.lt.link,
 					err:  errors.New("link path conflict between src dirs"),
 				})
 			}
 		} else {
-			if isDirLink[linkPath] {
-				combined.dirLinksToCreate = append(combined.dirLinksToCreate, ltcs[0])
-			} else {
-				combined.fileLinksToCreate = append(combined.fileLinksToCreate, ltcs[0])
-			}
+			*pls[0].dest = append(*pls[0].dest, pls[0].lt)
 		}
 	}
+	return combined, nil
+}
 
-	compareLinks := func(a, b linkT) int {
-		if n := cmp.Compare(a.link, b.link); n != 0 {
-			return n
+// findLinksIntoSrcDirs looks for symlinks whose targets are inside any of srcDirs.
+// Walking the whole link dirs (usually ~) would be too slow, so it only looks in
+// linkDirs themselves and in the existing dirs fi was walked into.
+// The src of each returned link is its resolved target.
+func findLinksIntoSrcDirs(linkDirs []string, srcDirs []string, fi *fileInfo) ([]linkT, error) {
+	var dirs []string
+	for _, linkDir := range linkDirs {
+		linkDir, err := filepath.Abs(linkDir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
 		}
-		return cmp.Compare(a.src, b.src)
+		dirs = append(dirs, linkDir)
 	}
-
-	slices.SortFunc(combined.dirLinksToCreate, compareLinks)
-	slices.SortFunc(combined.existingDirLinks, compareLinks)
-	slices.SortFunc(combined.existingFileLinks, compareLinks)
-	slices.SortFunc(combined.fileLinksToCreate, compareLinks)
-	slices.Sort(combined.ignoredPaths)
-	slices.SortFunc(combined.pathErrs, func(a, b pathErr) int {
-		if n := cmp.Compare(a.path, b.path); n != 0 {
-			return n
+	for _, ed := range fi.existingDirs {
+		dirs = append(dirs, ed.link)
+	}
+	// a link dir can also be an existing dir of another src dir
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+
+	var links []linkT
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// link will create it
+			continue
 		}
-		return cmp.Compare(a.err.Error(), b.err.Error())
-	})
-	slices.SortFunc(combined.pathsErrs, func(a pathsErr, b pathsErr) int {
-		if n := cmp.Compare(a.link, b.link); n != 0 {
-			return n
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dir to find links: %w", err)
 		}
-		if n := cmp.Compare(a.src, b.src); n != 0 {
-			return n
+		for _, e := range entries {
+			if e.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+			link := filepath.Join(dir, e.Name())
+			target, err := os.Readlink(link)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't read link: %w", err)
+			}
+			resolved := canonicalPath(resolveLinkTarget(link, target))
+			if isUnderAnyDir(resolved, srcDirs) {
+				links = append(links, linkT{src: resolved, link: link})
+			}
 		}
-		return cmp.Compare(a.err.Error(), b.err.Error())
-	})
+	}
+	return links, nil
+}
 
-	return combined, nil
+// findOrphanedLinks returns the links into srcDirs (see findLinksIntoSrcDirs)
+// whose targets don't exist.
+func findOrphanedLinks(linkDirs []string, srcDirs []string, fi *fileInfo) ([]orphanedLink, error) {
+	links, err := findLinksIntoSrcDirs(linkDirs, srcDirs, fi)
+	if err != nil {
+		return nil, err
+	}
+	var orphanedLinks []orphanedLink
+	for _, l := range links {
+		_, err := os.Lstat(l.src)
+		if errors.Is(err, fs.ErrNotExist) {
+			orphanedLinks = append(orphanedLinks, l)
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't stat link target: %w", err)
+		}
+	}
+	return orphanedLinks, nil
 }
 
-// the bool indicates whether to continue and the err indicates any errors
-func askPrompt(ask string) (bool, error) {
-	switch ask {
-	case "true":
-		fmt.Print("Type 'yes' to continue: ")
-		reader := bufio.NewReader(os.Stdin)
-		confirmation, err := reader.ReadString('\n')
+// checkLinkDirs reports link dirs fling can't safely link into when src dirs have their
+// own link dirs: link dirs that are links into a src dir, and link dirs a dir link to
+// create would contain.
+func checkLinkDirs(fi *fileInfo, srcDirs []string, linkDir string, opts fileInfoOpts) {
+	for _, ld := range opts.linkDirs(srcDirs, linkDir) {
+		ld, err := filepath.Abs(ld)
 		if err != nil {
-			err = fmt.Errorf("confirmation ReadString error: %w", err)
-			return false, err
+			continue
 		}
-		confirmation = strings.TrimSpace(confirmation)
-		if confirmation != "yes" {
-			err := fmt.Errorf("confirmation not yes: %v", confirmation)
-			return false, err
+		if isUnderAnyDir(canonicalDir(ld), srcDirs) {
+			fi.pathErrs = append(fi.pathErrs, pathErr{
+				path: ld,
+				err:  errors.New("link dir is inside a src dir (through a dir link?), so links would be created in the src dir"),
+			})
 		}
-		return true, nil
-	case "false":
+		var dirLinksToCreate []dirLinkToCreate
+		for _, e := range fi.dirLinksToCreate {
+			if ld == e.link || isUnderDir(ld, e.link) {
+				fi.pathsErrs = append(fi.pathsErrs, pathsErr{
+					src:  e.src,
+					link: e.link,
+					err:  fmt.Errorf("dir link would contain the link dir of another src dir: %s. Add it to --no-fold-path", ld),
+				})
+				continue
+			}
+			dirLinksToCreate = append(dirLinksToCreate, e)
+		}
+		fi.dirLinksToCreate = dirLinksToCreate
+	}
+}
+
+// buildCombinedFileInfo merges the fileInfo of all srcDirs (see mergeFileInfo).
+// When a src dir needs to add children to a dir link owned by another src dir,
+// it plans to unfold that link and re-plans all src dirs with the link unfolded.
+// Each src dir is linked into its own link dir if it has one (see linkDirFor), with
+// link path conflicts detected across all of them.
+func buildCombinedFileInfo(srcDirs []string, linkDir string, opts fileInfoOpts) (*fileInfo, error) {
+	linkDir, err := filepath.Abs(linkDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+	}
+
+	// link -> src of the dir link being unfolded
+	unfoldLinks := make(map[string]bool)
+	unfoldOwners := make(map[string]string)
+	var combined *fileInfo
+	for {
+		combined, err = mergeFileInfo(srcDirs, linkDir, opts, unfoldLinks)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates := combined.dirsToUnfold
+		combined.dirsToUnfold = nil
+		unfolded := false
+		for _, c := range candidates {
+			// only unfold if the src dir the link points to agrees it owns the link
+			owner := ""
+			for _, edl := range combined.existingDirLinks {
+				if edl.link == c.link && canonicalPath(edl.src) == c.src {
+					owner = edl.src
+				}
+			}
+			if owner == "" {
+				combined.pathsErrs = append(combined.pathsErrs, pathsErr{
+					src:  c.src,
+					link: c.link,
+					err:  errors.New("link is a symlink into a src dir, but not to the src dir path that maps to it"),
+				})
+				continue
+			}
+			unfoldLinks[c.link] = true
+			unfoldOwners[c.link] = owner
+			unfolded = true
+		}
+		if !unfolded {
+			break
+		}
+	}
+	for link, owner := range unfoldOwners {
+		combined.dirsToUnfold = append(combined.dirsToUnfold, dirToUnfold{src: owner, link: link})
+	}
+
+	combined.orphanedLinks, err = findOrphanedLinks(opts.linkDirs(srcDirs, linkDir), srcDirs, combined)
+	if err != nil {
+		return nil, err
+	}
+	checkLinkDirs(combined, srcDirs, linkDir, opts)
+	applyScope(combined, srcDirs, linkDir, opts)
+
+	slices.SortFunc(combined.chosenAlternates, func(a, b chosenAlternate) int {
+		return compareLinks(linkT{src: a.src, link: a.link}, linkT{src: b.src, link: b.link})
+	})
+	slices.SortFunc(combined.dirLinksToCreate, compareLinks)
+	slices.SortFunc(combined.dirsToCreate, compareLinks)
+	slices.SortFunc(combined.dirsToUnfold, compareLinks)
+	slices.SortFunc(combined.existingDirLinks, compareLinks)
+	slices.SortFunc(combined.existingDirs, compareLinks)
+	slices.SortFunc(combined.existingFileLinks, compareLinks)
+	slices.SortFunc(combined.fileLinksToCreate, compareLinks)
+	slices.SortFunc(combined.identicalFiles, compareLinks)
+	slices.SortFunc(combined.orphanedLinks, compareLinks)
+	slices.SortFunc(combined.pathsToAdopt, compareLinks)
+	slices.SortFunc(combined.pathsToBackup, compareLinks)
+	slices.SortFunc(combined.templatesToRender, compareTemplates)
+	slices.SortFunc(combined.ignoredPaths, compareIgnoredPaths)
+	slices.SortFunc(combined.pathErrs, func(a, b pathErr) int {
+		if n := cmp.Compare(a.path, b.path); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.err.Error(), b.err.Error())
+	})
+	slices.SortFunc(combined.pathsErrs, func(a pathsErr, b pathsErr) int {
+		if n := cmp.Compare(a.link, b.link); n != 0 {
+			return n
+		}
+		if n := cmp.Compare(a.src, b.src); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.err.Error(), b.err.Error())
+	})
+
+	return combined, nil
+}
+
+// planRefolds finds the dirs containing linksToDelete that, once those links are deleted, only
+// contain links to every entry of a single other dir. Those dirs can be replaced by a link
+// to that dir, reversing unfolding. Only dirs m records fling unfolded from that dir are refolded,
+// so dirs the user made (or fling unfolded from another dir) are left alone. No-fold dirs
+// (see isNoFoldDir) are never refolded.
+func planRefolds(linkDir string, linksToDelete []linkT, opts fileInfoOpts, m *manifest) ([]dirToRefold, error) {
+	linkDir, err := filepath.Abs(linkDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+	}
+
+	deleting := make(map[string]bool)
+	var candidates []string
+	for _, e := range linksToDelete {
+		deleting[e.link] = true
+		dir := filepath.Dir(e.link)
+		ld, err := filepath.Abs(opts.linkDirOf(e.src, linkDir))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+		}
+		if isUnderDir(dir, ld) && !slices.Contains(candidates, dir) && !isNoFoldDir(opts, filepath.Dir(e.src), dir, ld) {
+			candidates = append(candidates, dir)
+		}
+	}
+	slices.Sort(candidates)
+
+	var dirsToRefold []dirToRefold
+	for _, dir := range candidates {
+		md, found := m.findDir(dir)
+		if !found || md.UnfoldedFrom == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dir to check for refolding: %w", err)
+		}
+		var remaining []string
+		for _, e := range entries {
+			if !deleting[filepath.Join(dir, e.Name())] {
+				remaining = append(remaining, e.Name())
+			}
+		}
+		if len(remaining) == 0 {
+			continue
+		}
+
+		// every remaining entry must be a link to the entry with the same name in one dir
+		foldTo := ""
+		for _, name := range remaining {
+			p := filepath.Join(dir, name)
+			target, err := os.Readlink(p)
+			if err != nil {
+				foldTo = ""
+				break
+			}
+			resolved := canonicalPath(resolveLinkTarget(p, target))
+			if filepath.Base(resolved) != name || (foldTo != "" && filepath.Dir(resolved) != foldTo) {
+				foldTo = ""
+				break
+			}
+			foldTo = filepath.Dir(resolved)
+		}
+		if foldTo == "" || foldTo != canonicalDir(md.UnfoldedFrom) {
+			continue
+		}
+
+		// and that dir must have no other entries, so the link exposes the same contents
+		foldToEntries, err := os.ReadDir(foldTo)
+		if err != nil || len(foldToEntries) != len(remaining) {
+			continue
+		}
+		dirsToRefold = append(dirsToRefold, dirToRefold{src: foldTo, link: dir})
+	}
+	return dirsToRefold, nil
+}
+
+// planEmptyDirDeletes finds the no-fold dirs (see isNoFoldDir) containing linksToDelete (and their
+// parents, up to linkDir) that will be empty once those links are deleted. Only dirs m records fling
+// created are deleted, so dirs that were already there are kept. They're sorted with parents before
+// children.
+func planEmptyDirDeletes(linkDir string, linksToDelete []linkT, opts fileInfoOpts, m *manifest) ([]emptyDirToDelete, error) {
+	linkDir, err := filepath.Abs(linkDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+	}
+
+	deleting := make(map[string]bool)
+	for _, e := range linksToDelete {
+		deleting[e.link] = true
+	}
+
+	// a dir's src is the parent of its children's src, so walk both up together
+	var candidates []emptyDirToDelete
+	for _, e := range linksToDelete {
+		ld, err := filepath.Abs(opts.linkDirOf(e.src, linkDir))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+		}
+		src, link := filepath.Dir(e.src), filepath.Dir(e.link)
+		for ; isUnderDir(link, ld); src, link = filepath.Dir(src), filepath.Dir(link) {
+			if _, created := m.findDir(link); !created {
+				continue
+			}
+			if !slices.ContainsFunc(candidates, func(c emptyDirToDelete) bool { return c.link == link }) && isNoFoldDir(opts, src, link, ld) {
+				candidates = append(candidates, emptyDirToDelete{src: src, link: link})
+			}
+		}
+	}
+	// deepest first, so parents see whether their children will be deleted
+	slices.SortFunc(candidates, func(a, b emptyDirToDelete) int {
+		return cmp.Compare(b.link, a.link)
+	})
+
+	var emptyDirsToDelete []emptyDirToDelete
+	for _, c := range candidates {
+		entries, err := os.ReadDir(c.link)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dir to check if it will be empty: %w", err)
+		}
+		empty := true
+		for _, e := range entries {
+			if !deleting[filepath.Join(c.link, e.Name())] {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			deleting[c.link] = true
+			emptyDirsToDelete = append(emptyDirsToDelete, c)
+		}
+	}
+	slices.Reverse(emptyDirsToDelete)
+	return emptyDirsToDelete, nil
+}
+
+// the bool indicates whether to continue and the err indicates any errors
+func askPrompt(ask string, w io.Writer) (bool, error) {
+	switch ask {
+	case "true":
+		fmt.Fprint(w, "Type 'yes' to continue: ")
+		reader := bufio.NewReader(os.Stdin)
+		confirmation, err := reader.ReadString('\n')
+		if err != nil {
+			err = fmt.Errorf("confirmation ReadString error: %w", err)
+			return false, err
+		}
+		confirmation = strings.TrimSpace(confirmation)
+		if confirmation != "yes" {
+			err := fmt.Errorf("confirmation not yes: %v", confirmation)
+			return false, err
+		}
+		return true, nil
+	case "false":
 		return true, nil
 	case "dry-run":
 		return false, nil
@@ -527,265 +1385,657 @@ func askPrompt(ask string) (bool, error) {
 	}
 }
 
-func unlink(ctx warg.CmdContext) error {
-	ask := ctx.Flags["--ask"].(string)
+// commonFlags are the flags link, unlink, and sync share. Without --src-dir, the src dirs,
+// link dir, and their options come from the packages in the config file instead.
+type commonFlags struct {
+	ask     string
+	linkDir string
+	srcDirs []string
+	// opts.onConflict and opts.unfold are not flags, so they're left for each command to set
+	opts fileInfoOpts
+}
+
+func getCommonFlags(ctx warg.CmdContext) (commonFlags, error) {
+	// status doesn't take --ask, since it never changes anything
+	ask := ""
+	if askF, exists := ctx.Flags["--ask"]; exists {
+		ask = askF.(string)
+	}
 	linkDir := ctx.Flags["--link-dir"].(path.Path).MustExpand()
-	srcDirPaths := ctx.Flags["--src-dir"].([]path.Path)
-	srcDirs := make([]string, len(srcDirPaths))
-	for i, p := range srcDirPaths {
-		srcDirs[i] = p.MustExpand()
+	srcDirArgs := []string{}
+	if srcDirF, exists := ctx.Flags["--src-dir"]; exists {
+		for _, p := range srcDirF.([]path.Path) {
+			srcDirArgs = append(srcDirArgs, p.MustExpand())
+		}
 	}
 	isDotfiles := ctx.Flags["--dotfiles"].(bool)
+	noFolding := ctx.Flags["--no-folding"].(bool)
+	noFoldPaths := []string{}
+	if noFoldF, exists := ctx.Flags["--no-fold-path"]; exists {
+		noFoldPaths = noFoldF.([]string)
+	}
 	ignorePatterns := []string{}
 	if ignoreF, exists := ctx.Flags["--ignore"]; exists {
 		ignorePatterns = ignoreF.([]string)
 	}
+	ignorePaths := []string{}
+	if ignorePathF, exists := ctx.Flags["--ignore-path"]; exists {
+		ignorePaths = ignorePathF.([]string)
+	}
+	renameRules := []string{}
+	if renameF, exists := ctx.Flags["--rename"]; exists {
+		renameRules = renameF.([]string)
+	}
+	onlyPatterns := []string{}
+	if onlyF, exists := ctx.Flags["--only"]; exists {
+		onlyPatterns = onlyF.([]string)
+	}
+	targets := []string{}
+	if targetF, exists := ctx.Flags["--target"]; exists {
+		for _, p := range targetF.([]path.Path) {
+			targets = append(targets, p.MustExpand())
+		}
+	}
+	cf := commonFlags{
+		ask:     ask,
+		linkDir: linkDir,
+		srcDirs: nil,
+		opts: fileInfoOpts{
+			ignorePatterns: nil,
+			ignorePaths:    nil,
+			isDotfiles:     isDotfiles,
+			renameRules:    nil,
+			srcDirOpts:     nil,
+			onConflict:     "error",
+			machine:        currentMachine(),
+			templates:      nil,
+			scope:          nil,
+			noFolding:      noFolding,
+			noFoldPaths:    noFoldPaths,
+			unfold:         false,
+		},
+	}
+	// compile patterns up front, so a bad one fails before walking
+	var err error
+	cf.opts.ignorePatterns, err = compileIgnorePatterns(ignorePatterns)
+	if err != nil {
+		return cf, err
+	}
+	cf.opts.ignorePaths, err = compilePathGlobs("--ignore-path", ignorePaths)
+	if err != nil {
+		return cf, err
+	}
+	cf.opts.renameRules, err = parseRenameRules(renameRules)
+	if err != nil {
+		return cf, err
+	}
+	if len(onlyPatterns) > 0 || len(targets) > 0 {
+		only, err := compilePathGlobs("--only", onlyPatterns)
+		if err != nil {
+			return cf, err
+		}
+		for i, target := range targets {
+			targets[i], err = filepath.Abs(target)
+			if err != nil {
+				return cf, fmt.Errorf("couldn't get abs path for --target: %w", err)
+			}
+		}
+		cf.opts.scope = &scope{only: only, targets: targets}
+	}
 
-	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	cf.opts.templates, err = getTemplateOpts(ctx, cf.opts.machine)
+	if err != nil {
+		return cf, err
+	}
 
+	if len(srcDirArgs) > 0 {
+		if _, exists := ctx.Flags["--package"]; exists {
+			return cf, errors.New("--package selects packages in the config file, so it can't be used with --src-dir")
+		}
+		err := cf.setSrcDirs(srcDirArgs)
+		return cf, err
+	}
+
+	isManifest := false
+	if manifestF, exists := ctx.Flags["--manifest"]; exists {
+		isManifest = manifestF.(bool)
+	}
+	configP, err := configPath(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+		return cf, err
 	}
+	if configP == "" {
+		// only unlink --manifest can find links without src dirs
+		if isManifest {
+			return cf, nil
+		}
+		return cf, fmt.Errorf("pass --src-dir or add a %s to the current dir or one of its parents (or pass --config)", configFileName)
+	}
+	err = checkPackageOverrides(isDotfiles, ignorePatterns, renameRules, configP)
+	if err != nil {
+		return cf, err
+	}
+	err = cf.setPackages(ctx, configP)
+	return cf, err
+}
+
+// checkPackageOverrides returns an error if --dotfiles, --ignore, or --rename were passed
+// with the packages in the config file at configP. Packages set these for their src dir,
+// so they'd be silently ignored.
+func checkPackageOverrides(isDotfiles bool, ignorePatterns []string, renameRules []string, configP string) error {
+	var overridden []string
+	if !isDotfiles {
+		overridden = append(overridden, "--dotfiles")
+	}
+	if !slices.Equal(ignorePatterns, defaultIgnorePatterns()) {
+		overridden = append(overridden, "--ignore")
+	}
+	if len(renameRules) > 0 {
+		overridden = append(overridden, "--rename")
+	}
+	if len(overridden) > 0 {
+		return fmt.Errorf("%s can't be used with the packages in %s, since each package sets its own dotfiles, ignore, and rename. Set them in the config file or pass --src-dir instead", strings.Join(overridden, ", "), configP)
+	}
+	return nil
+}
 
-	fi, err := buildCombinedFileInfo(srcDirs, linkDir, ignorePatterns, isDotfiles)
+// getTemplateOpts returns the templateOpts for machine m, with the data file from --template-data
+func getTemplateOpts(ctx warg.CmdContext, m machineFacts) (*templateOpts, error) {
+	templateDataP, err := defaultTemplateDataPath()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	templateDataF, mustExist := ctx.Flags["--template-data"]
+	if mustExist {
+		templateDataP = templateDataF.(path.Path).MustExpand()
 	}
+	return newTemplateOpts(m, templateDataP, mustExist)
+}
 
-	// Print fileInfo
-	{
-		f := bufio.NewWriter(os.Stdout)
+// splitSrcDirArg splits a --src-dir into the src dir and, for src:linkdir pairs, the
+// link dir (with ~ expanded). The bool reports whether arg is a pair. An arg that's an
+// existing dir is never split, so src dirs with a ':' in their name still work.
+func splitSrcDirArg(arg string) (string, string, bool) {
+	if info, err := os.Stat(arg); err == nil && info.IsDir() {
+		return arg, "", false
+	}
+	// don't split the volume name (like C:) on Windows
+	vol := filepath.VolumeName(arg)
+	srcDir, linkDir, isPair := strings.Cut(arg[len(vol):], ":")
+	if !isPair {
+		return arg, "", false
+	}
+	return vol + srcDir, path.New(linkDir).MustExpand(), true
+}
 
-		if len(fi.ignoredPaths) > 0 {
-			fPrintHeader(f, &color, "Ignored paths:")
-			for _, e := range fi.ignoredPaths {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
+// setSrcDirs sets cf's src dirs from --src-dir args. src:linkdir pairs link src into
+// linkdir instead of --link-dir.
+func (cf *commonFlags) setSrcDirs(args []string) error {
+	for _, arg := range args {
+		srcDir, linkDir, isPair := splitSrcDirArg(arg)
+		if srcDir == "" || (isPair && linkDir == "") {
+			return fmt.Errorf("--src-dir should be a src dir or a src:linkdir pair: %s", arg)
 		}
-
-		if len(fi.dirLinksToCreate) > 0 {
-			fPrintHeader(f, &color, "Uncreated dir links:")
-			fPrintLinkTs(f, &color, fi.dirLinksToCreate)
-			fmt.Fprintln(f)
+		if slices.Contains(cf.srcDirs, srcDir) {
+			return fmt.Errorf("--src-dir passed more than once: %s", srcDir)
+		}
+		cf.srcDirs = append(cf.srcDirs, srcDir)
+		if !isPair {
+			continue
 		}
+		linkDir, err := filepath.Abs(linkDir)
+		if err != nil {
+			return fmt.Errorf("couldn't get abs path for link dir: %s: %w", arg, err)
+		}
+		if cf.opts.srcDirOpts == nil {
+			cf.opts.srcDirOpts = make(map[string]srcDirOpts)
+		}
+		cf.opts.srcDirOpts[srcDir] = srcDirOpts{
+			linkDir:        linkDir,
+			ignorePatterns: cf.opts.ignorePatterns,
+			isDotfiles:     cf.opts.isDotfiles,
+			renameRules:    cf.opts.renameRules,
+		}
+	}
+	return nil
+}
+
+// setPackages sets cf's src dirs, link dirs, and per src dir options from the packages in
+// the config file at configP selected by --package
+func (cf *commonFlags) setPackages(ctx warg.CmdContext, configP string) error {
+	cfg, errs := readConfig(configP)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config file (see 'fling config validate'):\n%w", errors.Join(errs...))
+	}
+	names := []string{}
+	if packageF, exists := ctx.Flags["--package"]; exists {
+		names = packageF.([]string)
+	}
+	pkgs, err := cfg.selectPackages(names)
+	if err != nil {
+		return err
+	}
 
-		if len(fi.fileLinksToCreate) > 0 {
-			fPrintHeader(f, &color, "Uncreated file links:")
-			fPrintLinkTs(f, &color, fi.fileLinksToCreate)
-			fmt.Fprintln(f)
+	// packages each have their own link dir, so this is only recorded in the journal
+	cf.linkDir = pkgs[0].linkDir
+	cf.opts.srcDirOpts = make(map[string]srcDirOpts)
+	for _, pkg := range pkgs {
+		// parseConfig already checked these compile
+		ignorePatterns, err := compileIgnorePatterns(pkg.ignorePatterns)
+		if err != nil {
+			return err
 		}
+		renameRules, err := parseRenameRules(pkg.renameRules)
+		if err != nil {
+			return err
+		}
+		cf.srcDirs = append(cf.srcDirs, pkg.src)
+		cf.opts.srcDirOpts[pkg.src] = srcDirOpts{
+			linkDir:        pkg.linkDir,
+			ignorePatterns: ignorePatterns,
+			isDotfiles:     pkg.isDotfiles,
+			renameRules:    renameRules,
+		}
+	}
+	return nil
+}
 
-		if len(fi.existingDirLinks) > 0 {
-			fPrintHeader(f, &color, "Dir links to delete:")
-			fPrintLinkTs(f, &color, fi.existingDirLinks)
-			fmt.Fprintln(f)
+// fPrintPathErrs prints the pathErrs and pathsErrs sections, which link, unlink, and sync share
+func fPrintPathErrs(f *bufio.Writer, color *gocolor.Color, fi *fileInfo) {
+	if len(fi.pathErrs) > 0 {
+		fPrintErrorHeader(f, color, "Path errors:")
+		for _, e := range fi.pathErrs {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
+		fmt.Fprintln(f)
+	}
 
-		if len(fi.existingFileLinks) > 0 {
-			fPrintHeader(f, &color, "File links to delete:")
-			fPrintLinkTs(f, &color, fi.existingFileLinks)
-			fmt.Fprintln(f)
+	if len(fi.pathsErrs) > 0 {
+		fPrintErrorHeader(f, color, "Proposed link mismatch errors:")
+		for _, e := range fi.pathsErrs {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
+		fmt.Fprintln(f)
+	}
+}
 
-		if len(fi.pathErrs) > 0 {
-			fPrintErrorHeader(f, &color, "Path errors:")
-			for _, e := range fi.pathErrs {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
+// fPrintLinkPlan prints what link will do, except for errors (see fPrintPathErrs)
+func fPrintLinkPlan(f *bufio.Writer, color *gocolor.Color, fi *fileInfo) {
+	if len(fi.ignoredPaths) > 0 {
+		fPrintHeader(f, color, "Ignored paths:")
+		for _, e := range fi.ignoredPaths {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
+		fmt.Fprintln(f)
+	}
 
-		if len(fi.pathsErrs) > 0 {
-			fPrintErrorHeader(f, &color, "Proposed link mismatch errors:")
-			for _, e := range fi.pathsErrs {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
+	if len(fi.outOfScope) > 0 {
+		fPrintHeader(f, color, "Out of scope (not matched by --only or --target, so left alone):")
+		fPrintLinkTs(f, color, fi.outOfScope)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.chosenAlternates) > 0 {
+		fPrintHeader(f, color, "Alternates chosen for this machine (other alternates are ignored):")
+		for _, e := range fi.chosenAlternates {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
-		f.Flush()
+		fmt.Fprintln(f)
 	}
-	if len(fi.pathsErrs) > 0 {
-		return fmt.Errorf("resolve errors above before deleting links")
-	}
-	if len(fi.existingFileLinks) == 0 && len(fi.existingDirLinks) == 0 {
-		fmt.Print(
-			color.Add(
-				color.Bold+color.FgGreenBright,
-				"Nothing to do!\n",
-			),
-		)
-		return nil // exit
-	}
-	fmt.Print(
-		color.Add(
-			color.Bold,
-			"Delete links?\n",
-		),
-	)
 
-	keepGoing, err := askPrompt(ask)
-	if !keepGoing {
-		if err == nil {
-			fmt.Print(
-				color.Add(
-					color.Bold+color.FgGreenBright,
-					"Dry run - no changes made\n",
-				),
-			)
+	if len(fi.templatesToRender) > 0 {
+		fPrintHeader(f, color, "Templates to render (their links point to the rendered file):")
+		for _, e := range fi.templatesToRender {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
-		return err
+		fmt.Fprintln(f)
 	}
 
-	for _, e := range fi.existingDirLinks {
-		err := os.Remove(e.link)
-		if err != nil {
-			return err
+	if len(fi.dirsToUnfold) > 0 {
+		fPrintHeader(f, color, "Dir links to unfold (replace with a real dir and link src's children):")
+		fPrintLinkTs(f, color, fi.dirsToUnfold)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.dirsToCreate) > 0 {
+		fPrintHeader(f, color, "Dirs to create:")
+		fPrintLinkTs(f, color, fi.dirsToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.dirLinksToCreate) > 0 {
+		fPrintHeader(f, color, "Dir links to create:")
+		fPrintLinkTs(f, color, fi.dirLinksToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.fileLinksToCreate) > 0 {
+		fPrintHeader(f, color, "File links to create:")
+		fPrintLinkTs(f, color, fi.fileLinksToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.identicalFiles) > 0 {
+		fPrintHeader(f, color, "Identical files to replace with links:")
+		fPrintLinkTs(f, color, fi.identicalFiles)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.pathsToAdopt) > 0 {
+		fPrintHeader(f, color, "Paths to adopt (move link to src, replacing src, then create link):")
+		fPrintLinkTs(f, color, fi.pathsToAdopt)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.pathsToBackup) > 0 {
+		fPrintHeader(f, color, "Paths to back up (rename link with a "+backupInfix+"<timestamp> suffix, then create link):")
+		fPrintLinkTs(f, color, fi.pathsToBackup)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.existingDirLinks) > 0 {
+		fPrintHeader(f, color, "Pre-existing correct dir links:")
+		fPrintLinkTs(f, color, fi.existingDirLinks)
+		fmt.Fprintln(f)
+	}
+	if len(fi.existingFileLinks) > 0 {
+		fPrintHeader(f, color, "Pre-existing correct file links:")
+		fPrintLinkTs(f, color, fi.existingFileLinks)
+		fmt.Fprintln(f)
+	}
+}
+
+// fPrintOrphanedLinks prints the orphaned links link and status leave alone
+func fPrintOrphanedLinks(f *bufio.Writer, color *gocolor.Color, fi *fileInfo) {
+	if len(fi.orphanedLinks) > 0 {
+		fPrintHeader(f, color, "Orphaned links (src doesn't exist, delete with 'fling prune'):")
+		fPrintLinkTs(f, color, fi.orphanedLinks)
+		fmt.Fprintln(f)
+	}
+}
+
+// hasLinksToCreate reports whether link has anything to do
+func hasLinksToCreate(fi *fileInfo) bool {
+	return len(fi.fileLinksToCreate) > 0 ||
+		len(fi.dirLinksToCreate) > 0 ||
+		len(fi.dirsToCreate) > 0 ||
+		len(fi.dirsToUnfold) > 0 ||
+		len(fi.identicalFiles) > 0 ||
+		len(fi.pathsToAdopt) > 0 ||
+		len(fi.pathsToBackup) > 0 ||
+		len(fi.templatesToRender) > 0
+}
+
+// linksToDelete is what unlink (and sync) will delete, along with the cleanup that follows
+type linksToDelete struct {
+	links             []linkT
+	emptyDirsToDelete []emptyDirToDelete
+	dirsToRefold      []dirToRefold
+	backupsToRestore  []backupToRestore
+}
+
+// planDeleteLinks plans deleting links, then cleaning up the dirs they leave
+// behind that m records fling created (see planEmptyDirDeletes and planRefolds) and optionally
+// restoring the last backup m records fling made of each link. A recorded backup that's
+// gone is an error, since unlinking would leave nothing in its place.
+func planDeleteLinks(linkDir string, links []linkT, opts fileInfoOpts, m *manifest, restoreBackups bool) (*linksToDelete, error) {
+	// fling created the no-fold dirs the links are in, so it cleans them up instead of refolding them
+	dirsToRefold, err := planRefolds(linkDir, links, opts, m)
+	if err != nil {
+		return nil, err
+	}
+	emptyDirsToDelete, err := planEmptyDirDeletes(linkDir, links, opts, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var backupsToRestore []backupToRestore
+	if restoreBackups {
+		for _, e := range links {
+			link, err := filepath.Abs(e.link)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't make link absolute: %w", err)
+			}
+			mb, found := m.latestBackup(link)
+			if !found {
+				continue
+			}
+			_, err = os.Lstat(mb.Backup)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("fling backed up %s to %s, but the backup is gone (unlink without --restore-backups to delete the link anyway)", e.link, mb.Backup)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("couldn't check backup: %w", err)
+			}
+			backupsToRestore = append(backupsToRestore, backupToRestore{backup: mb.Backup, link: e.link})
 		}
 	}
-	for _, e := range fi.existingFileLinks {
-		err := os.Remove(e.link)
-		if err != nil {
-			return err
+	return &linksToDelete{
+		links:             links,
+		emptyDirsToDelete: emptyDirsToDelete,
+		dirsToRefold:      dirsToRefold,
+		backupsToRestore:  backupsToRestore,
+	}, nil
+}
+
+// fPrintDeleteCleanup prints the cleanup after deleting links in ltd (but not the links themselves)
+func fPrintDeleteCleanup(f *bufio.Writer, color *gocolor.Color, ltd *linksToDelete) {
+	if len(ltd.emptyDirsToDelete) > 0 {
+		fPrintHeader(f, color, "Empty dirs to delete:")
+		fPrintLinkTs(f, color, ltd.emptyDirsToDelete)
+		fmt.Fprintln(f)
+	}
+
+	if len(ltd.dirsToRefold) > 0 {
+		fPrintHeader(f, color, "Dirs to refold (replace with a link to the only src dir left linked in it):")
+		fPrintLinkTs(f, color, ltd.dirsToRefold)
+		fmt.Fprintln(f)
+	}
+
+	if len(ltd.backupsToRestore) > 0 {
+		fPrintHeader(f, color, "Backups to restore:")
+		for _, e := range ltd.backupsToRestore {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
 		}
+		fmt.Fprintln(f)
 	}
-	fmt.Print(
-		color.Add(
-			color.Bold+color.FgGreenBright,
-			"Done!\n",
-		),
-	)
-	return nil
 }
 
-func link(ctx warg.CmdContext) error {
-	ask := ctx.Flags["--ask"].(string)
-	linkDir := ctx.Flags["--link-dir"].(path.Path).MustExpand()
-	srcDirPaths := ctx.Flags["--src-dir"].([]path.Path)
-	srcDirs := make([]string, len(srcDirPaths))
-	for i, p := range srcDirPaths {
-		srcDirs[i] = p.MustExpand()
+// fPrintUnlinkPlan prints what unlink will do, except for errors (see fPrintPathErrs)
+func fPrintUnlinkPlan(f *bufio.Writer, color *gocolor.Color, fi *fileInfo, ltd *linksToDelete) {
+	if len(fi.ignoredPaths) > 0 {
+		fPrintHeader(f, color, "Ignored paths:")
+		for _, e := range fi.ignoredPaths {
+			fmt.Fprintf(f, "%s\n", e.ColorString(color))
+		}
+		fmt.Fprintln(f)
 	}
-	isDotfiles := ctx.Flags["--dotfiles"].(bool)
-	ignorePatterns := []string{}
-	if ignoreF, exists := ctx.Flags["--ignore"]; exists {
-		ignorePatterns = ignoreF.([]string)
+
+	if len(fi.outOfScope) > 0 {
+		fPrintHeader(f, color, "Out of scope (not matched by --only or --target, so left alone):")
+		fPrintLinkTs(f, color, fi.outOfScope)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.dirsToCreate) > 0 {
+		fPrintHeader(f, color, "Uncreated dirs:")
+		fPrintLinkTs(f, color, fi.dirsToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.dirLinksToCreate) > 0 {
+		fPrintHeader(f, color, "Uncreated dir links:")
+		fPrintLinkTs(f, color, fi.dirLinksToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.fileLinksToCreate) > 0 {
+		fPrintHeader(f, color, "Uncreated file links:")
+		fPrintLinkTs(f, color, fi.fileLinksToCreate)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.existingDirLinks) > 0 {
+		fPrintHeader(f, color, "Dir links to delete:")
+		fPrintLinkTs(f, color, fi.existingDirLinks)
+		fmt.Fprintln(f)
 	}
 
+	if len(fi.existingFileLinks) > 0 {
+		fPrintHeader(f, color, "File links to delete:")
+		fPrintLinkTs(f, color, fi.existingFileLinks)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.orphanedLinks) > 0 {
+		fPrintHeader(f, color, "Orphaned links to delete (src doesn't exist):")
+		fPrintLinkTs(f, color, fi.orphanedLinks)
+		fmt.Fprintln(f)
+	}
+
+	if len(fi.identicalFiles) > 0 {
+		fPrintHeader(f, color, "Files identical to src (not links, won't be deleted):")
+		fPrintLinkTs(f, color, fi.identicalFiles)
+		fmt.Fprintln(f)
+	}
+
+	fPrintDeleteCleanup(f, color, ltd)
+}
+
+func unlink(ctx warg.CmdContext) error {
+	restoreBackups := ctx.Flags["--restore-backups"].(bool)
+	format := ctx.Flags["--format"].(string)
+
 	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
 	}
 
-	fi, err := buildCombinedFileInfo(srcDirs, linkDir, ignorePatterns, isDotfiles)
+	// created first so every error is reported in --format
+	r := newReporter(format, &color, "unlink")
+
+	cf, err := getCommonFlags(ctx)
 	if err != nil {
-		return err
+		return r.finish(outcomeErrors, err)
 	}
 
-	// Print fileInfo
-	{
+	if ctx.Flags["--manifest"].(bool) {
+		return unlinkFromManifest(ctx, cf, restoreBackups, r)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	m := readStateManifest("dirs fling created won't be cleaned up or backups restored")
+	ltd, err := planDeleteLinks(cf.linkDir, slices.Concat(fi.existingDirLinks, fi.existingFileLinks, fi.orphanedLinks), cf.opts, m, restoreBackups)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	if r.isJSON() {
+		r.doc.FileInfo = newJSONFileInfo(fi)
+		r.doc.LinksToDelete = newJSONLinksToDelete(ltd)
+	} else {
 		f := bufio.NewWriter(os.Stdout)
+		fPrintUnlinkPlan(f, &color, fi, ltd)
+		fPrintPathErrs(f, &color, fi)
+		f.Flush()
+	}
+	if len(fi.pathsErrs) > 0 {
+		return r.finish(outcomeErrors, errors.New("resolve errors above before deleting links"))
+	}
+	if len(ltd.links) == 0 {
+		return r.finish(outcomeNothingToDo, nil)
+	}
 
-		if len(fi.ignoredPaths) > 0 {
-			fPrintHeader(f, &color, "Ignored paths:")
-			for _, e := range fi.ignoredPaths {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
-		}
+	ops, err := unlinkOps(ltd)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
 
-		if len(fi.dirLinksToCreate) > 0 {
-			fPrintHeader(f, &color, "Dir links to create:")
-			fPrintLinkTs(f, &color, fi.dirLinksToCreate)
-			fmt.Fprintln(f)
+	keepGoing, err := r.ask("Delete links?", cf.ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
 		}
+		return r.finish(outcomeAborted, err)
+	}
 
-		if len(fi.fileLinksToCreate) > 0 {
-			fPrintHeader(f, &color, "File links to create:")
-			fPrintLinkTs(f, &color, fi.fileLinksToCreate)
-			fmt.Fprintln(f)
-		}
+	err = applyAndRecord(ctx.Context, "unlink", cf.srcDirs, cf.linkDir, ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
 
-		if len(fi.existingDirLinks) > 0 {
-			fPrintHeader(f, &color, "Pre-existing correct dir links:")
-			fPrintLinkTs(f, &color, fi.existingDirLinks)
-			fmt.Fprintln(f)
-		}
-		if len(fi.existingFileLinks) > 0 {
-			fPrintHeader(f, &color, "Pre-existing correct file links:")
-			fPrintLinkTs(f, &color, fi.existingFileLinks)
-			fmt.Fprintln(f)
-		}
+func link(ctx warg.CmdContext) error {
+	linkStyle := ctx.Flags["--link-style"].(string)
+	format := ctx.Flags["--format"].(string)
 
-		if len(fi.pathErrs) > 0 {
-			fPrintErrorHeader(f, &color, "Path errors:")
-			for _, e := range fi.pathErrs {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
-		}
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
 
-		if len(fi.pathsErrs) > 0 {
-			fPrintErrorHeader(f, &color, "Proposed link mismatch errors:")
-			for _, e := range fi.pathsErrs {
-				fmt.Fprintf(f, "%s\n", e.ColorString(&color))
-			}
-			fmt.Fprintln(f)
-		}
+	// created first so every error is reported in --format
+	r := newReporter(format, &color, "link")
+
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+	cf.opts.onConflict = ctx.Flags["--on-conflict"].(string)
+	cf.opts.unfold = true
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	if r.isJSON() {
+		r.doc.FileInfo = newJSONFileInfo(fi)
+	} else {
+		f := bufio.NewWriter(os.Stdout)
+		fPrintLinkPlan(f, &color, fi)
+		fPrintOrphanedLinks(f, &color, fi)
+		fPrintPathErrs(f, &color, fi)
 		f.Flush()
 	}
 
 	if len(fi.pathsErrs) > 0 {
-		return fmt.Errorf("resolve errors above before creating links")
+		return r.finish(outcomeErrors, errors.New("resolve errors above before creating links"))
 	}
 
-	if len(fi.fileLinksToCreate) == 0 && len(fi.dirLinksToCreate) == 0 {
-		fmt.Print(
-			color.Add(
-				color.Bold+color.FgGreenBright,
-				"Nothing to do!\n",
-			),
-		)
-		return nil // exit
+	if !hasLinksToCreate(fi) {
+		return r.finish(outcomeNothingToDo, nil)
 	}
 
-	fmt.Print(
-		color.Add(
-			color.Bold,
-			"Create links?\n",
-		),
-	)
+	ops, err := linkOps(fi, linkStyle)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	// check before asking, so paths that can't be adopted (like ones on another filesystem) are reported first
+	err = checkOps(ops)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
 
-	keepGoing, err := askPrompt(ask)
+	keepGoing, err := r.ask("Create links?", cf.ask)
 	if !keepGoing {
 		if err == nil {
-			fmt.Print(
-				color.Add(
-					color.Bold+color.FgGreenBright,
-					"Dry run - no changed made\n",
-				),
-			)
+			return r.finish(outcomeDryRun, nil)
 		}
-		return err
+		return r.finish(outcomeAborted, err)
 	}
 
-	for _, e := range fi.dirLinksToCreate {
-		err := os.Symlink(e.src, e.link)
-		if err != nil {
-			return err
-		}
-	}
-	for _, e := range fi.fileLinksToCreate {
-		err := os.Symlink(e.src, e.link)
-		if err != nil {
-			return err
-		}
+	err = applyAndRecord(ctx.Context, "link", cf.srcDirs, cf.linkDir, ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
 	}
-	fmt.Print(
-		color.Add(
-			color.Bold+color.FgGreenBright,
-			"Done!\n",
-		),
-	)
-	return nil
+	return r.finish(outcomeDone, nil)
 }
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile creates the file at p if needed and holds an exclusive lock on it until
+// the returned unlock is called. The lock is released when fling exits, so a
+// crashed fling never leaves it held.
+func lockFile(p string) (func(), error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open lock file: %w", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("couldn't lock %s: %w", p, err)
+	}
+	return func() { _ = f.Close() }, nil
+}
@@ -0,0 +1,35 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// lockTimeout is how long lockFile waits for another fling to delete the lock file
+const lockTimeout = 10 * time.Second
+
+// lockFile creates the file at p, waiting while another fling has it, and deletes it
+// when the returned unlock is called. A crashed fling can leave it behind, so
+// waiting gives up after lockTimeout.
+func lockFile(p string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(p) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("couldn't create lock file: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("another fling has held %s for over %s (delete it if no fling is running)", p, lockTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+
 	"go.bbkane.com/warg"
 	"go.bbkane.com/warg/path"
 	"go.bbkane.com/warg/value/scalar"
@@ -10,6 +15,13 @@ import (
 var version string
 
 func app() *warg.App {
+	configFlags := warg.FlagMap{
+		"--config": warg.NewFlag(
+			"Config file declaring packages (src dirs with their link dir, ignore patterns, and dotfiles setting). Defaults to the first "+configFileName+" found in the current dir or its parents",
+			scalar.Path(),
+		),
+	}
+
 	linkUnlinkFlags := warg.FlagMap{
 		"--ask": warg.NewFlag(
 			"Whether to ask before making changes",
@@ -20,20 +32,24 @@ func app() *warg.App {
 			warg.Required(),
 		),
 		"--dotfiles": warg.NewFlag(
-			"Files/dirs starting with 'dot-' will have links starting with '.'",
+			"Files/dirs starting with 'dot-' will have links starting with '.'. Packages in the config file set their own",
 			scalar.Bool(
 				scalar.Default(true),
 			),
 			warg.Required(),
 		),
 		"--ignore": warg.NewFlag(
-			"Ignore file/dir if the name (not the whole path) matches passed regex",
+			"Ignore file/dir if the name (not the whole path) matches passed regex. Gitignore-style "+ignoreFileName+" files in src dirs take precedence, so they can re-include paths with !. Packages in the config file set their own",
 			slice.String(
-				slice.Default([]string{"README.*"}),
+				slice.Default(defaultIgnorePatterns()),
 			),
 			warg.Alias("-i"),
 			warg.UnsetSentinel("UNSET"),
 		),
+		"--ignore-path": warg.NewFlag(
+			"Ignore file/dir if its path relative to the src dir (like nvim/lazy-lock.json or dot-config/*/cache) matches passed glob. Supports *, ?, [a-z], **, and a trailing / for dirs only, like "+ignoreFileName+" files",
+			slice.String(),
+		),
 		"--link-dir": warg.NewFlag(
 			"Symlinks will be created in this directory pointing to files/directories in --src-dir",
 			scalar.Path(
@@ -43,11 +59,99 @@ func app() *warg.App {
 			warg.FlagCompletions(warg.CompletionsDirectories()),
 			warg.Required(),
 		),
+		"--no-fold-path": warg.NewFlag(
+			"Path relative to --link-dir (like .config) that is always a real dir instead of a dir link, like --no-folding. Src dirs containing a '"+noFoldMarker+"' file are also never linked",
+			slice.String(
+				slice.Default([]string{".config", ".local/share", ".ssh"}),
+			),
+			warg.UnsetSentinel("UNSET"),
+		),
+		"--no-folding": warg.NewFlag(
+			"Never link dirs. link creates real dirs (with the src dir's permissions) and links only files in them. unlink deletes the dirs it created once they're empty",
+			scalar.Bool(
+				scalar.Default(false),
+			),
+			warg.Required(),
+		),
+		"--only": warg.NewFlag(
+			"Only plan links for paths relative to the src dir or --link-dir (like dot-config/nvim or .config/nvim) that match (or are inside a dir that matches) passed glob. Other paths are reported as out of scope and left alone. Supports the same globs as --ignore-path",
+			slice.String(),
+		),
+		"--package": warg.NewFlag(
+			"Name of a package in the config file to use instead of all of them. Pass multiple times to use multiple packages",
+			slice.String(),
+		),
 		"--src-dir": warg.NewFlag(
-			"Directory containing files and directories to link to. Pass multiple times to link from multiple directories.",
+			"Directory containing files and directories to link to. Pass multiple times to link from multiple directories. Pass src:linkdir (like ~/dotfiles/etc:~/.local/etc) to link a src dir into its own link dir instead of --link-dir (existing dirs with a : in their name aren't split). Without it, packages from the config file are used instead, with their own link dir, --ignore, and --dotfiles",
 			slice.Path(),
 			warg.Alias("-s"),
 			warg.FlagCompletions(warg.CompletionsDirectories()),
+		),
+		"--rename": warg.NewFlag(
+			"Rename rule applied to the name of each file/dir in the src dir to get its link's name, after --dotfiles. Pass multiple times to apply rules in order. Written as <kind><sep><from><sep><to>, where kind is prefix, suffix, or regex: prefix:dot-:. (what --dotfiles does), suffix:.symlink:, or regex/^_(.*)$/.$1. Packages in the config file set their own",
+			slice.String(),
+		),
+		"--target": warg.NewFlag(
+			"Only plan links for this src or link path (like ~/.config/nvim) and the paths inside it. Other paths are reported as out of scope and left alone. Pass multiple times for multiple paths. Combines with --only",
+			slice.Path(),
+			warg.Alias("-t"),
+			warg.FlagCompletions(warg.CompletionsDirectories()),
+		),
+		"--template-data": warg.NewFlag(
+			"YAML file of values src files ending in "+templateExt+" can use as {{ .Data.<key> }}. Defaults to $XDG_CONFIG_HOME/fling/data.yaml (or ~/.config/fling/data.yaml) if it exists",
+			scalar.Path(),
+		),
+	}
+
+	// status never changes anything, so it doesn't ask
+	statusFlags := maps.Clone(linkUnlinkFlags)
+	delete(statusFlags, "--ask")
+
+	linkFlags := warg.FlagMap{
+		"--link-style": warg.NewFlag(
+			"Whether created symlinks point to absolute paths or to paths relative to the link's directory (like GNU Stow)",
+			scalar.String(
+				scalar.Choices("absolute", "relative"),
+				scalar.Default("absolute"),
+			),
+			warg.Required(),
+		),
+		"--on-conflict": warg.NewFlag(
+			"What to do when a file or dir is in the way of a link. 'adopt' moves it into the src dir (replacing the src file) and links it. 'backup' renames it with a "+backupInfix+"<timestamp> suffix and links it",
+			scalar.String(
+				scalar.Choices("error", "adopt", "backup"),
+				scalar.Default("error"),
+			),
+			warg.Required(),
+		),
+	}
+
+	unlinkFlags := warg.FlagMap{
+		"--restore-backups": warg.NewFlag(
+			"After deleting a link, rename the last backup 'fling link --on-conflict backup' made of it back into its place",
+			scalar.Bool(
+				scalar.Default(false),
+			),
+			warg.Required(),
+		),
+	}
+
+	planFlags := warg.FlagMap{
+		"--output": warg.NewFlag(
+			"File to save the plan to",
+			scalar.Path(),
+			warg.Alias("-o"),
+			warg.Required(),
+		),
+	}
+
+	formatFlags := warg.FlagMap{
+		"--format": warg.NewFlag(
+			"Print the plan and outcome as colored text or as one versioned JSON document. With json, prompts are printed to stderr",
+			scalar.String(
+				scalar.Choices(formatText, formatJSON),
+				scalar.Default(formatText),
+			),
 			warg.Required(),
 		),
 	}
@@ -62,12 +166,123 @@ func app() *warg.App {
 				"Create links",
 				link,
 				warg.CmdFlagMap(linkUnlinkFlags),
+				warg.CmdFlagMap(configFlags),
+				warg.CmdFlagMap(linkFlags),
+				warg.CmdFlagMap(formatFlags),
 			),
 			warg.NewSubCmd(
 				"unlink",
 				"Unlink previously created links",
 				unlink,
 				warg.CmdFlagMap(linkUnlinkFlags),
+				warg.CmdFlagMap(configFlags),
+				warg.CmdFlagMap(unlinkFlags),
+				warg.CmdFlagMap(formatFlags),
+				warg.NewCmdFlag(
+					"--manifest",
+					"Delete the links fling recorded creating in its manifest (in $XDG_STATE_HOME/fling or ~/.local/state/fling) that are in --link-dir and still point where fling put them, instead of finding links from --src-dir. --src-dir is optional and limits which links are deleted. Works after src dirs are moved or deleted",
+					scalar.Bool(
+						scalar.Default(false),
+					),
+					warg.Required(),
+				),
+			),
+			warg.NewSubCmd(
+				"apply",
+				"Check a plan saved by 'fling plan' still applies, then apply it",
+				apply,
+				warg.CmdFlagMap(warg.FlagMap{"--ask": linkUnlinkFlags["--ask"], "--template-data": linkUnlinkFlags["--template-data"]}),
+				warg.NewCmdFlag(
+					"--plan-file",
+					"Plan file saved by 'fling plan'",
+					scalar.Path(),
+					warg.Alias("-p"),
+					warg.Required(),
+				),
+			),
+			warg.NewSubSection(
+				"plan",
+				"Save what a command would do to a file for 'fling apply'",
+				warg.NewSubCmd(
+					"link",
+					"Plan creating links",
+					planLink,
+					warg.CmdFlagMap(linkUnlinkFlags),
+					warg.CmdFlagMap(configFlags),
+					warg.CmdFlagMap(linkFlags),
+					warg.CmdFlagMap(planFlags),
+				),
+				warg.NewSubCmd(
+					"unlink",
+					"Plan unlinking previously created links",
+					planUnlink,
+					warg.CmdFlagMap(linkUnlinkFlags),
+					warg.CmdFlagMap(configFlags),
+					warg.CmdFlagMap(unlinkFlags),
+					warg.CmdFlagMap(planFlags),
+				),
+			),
+			warg.NewSubSection(
+				"config",
+				"Work with the config file ("+configFileName+")",
+				warg.NewSubCmd(
+					"validate",
+					"Check the config file and print errors with their line numbers",
+					configValidate,
+					warg.CmdFlagMap(configFlags),
+				),
+			),
+			warg.NewSubCmd(
+				"history",
+				"List the runs recorded in the journal (in $XDG_STATE_HOME/fling/journal or ~/.local/state/fling/journal)",
+				history,
+			),
+			warg.NewSubCmd(
+				"import",
+				"Move a file or dir in the link dir (like ~/.tmux.conf) into the src dir whose link dir it's in, named so --dotfiles and --rename map it back (like dot-tmux.conf), then link it",
+				importCmd,
+				warg.CmdFlagMap(linkUnlinkFlags),
+				warg.CmdFlagMap(configFlags),
+				warg.CmdFlagMap(warg.FlagMap{"--link-style": linkFlags["--link-style"]}),
+				warg.NewCmdFlag(
+					"--path",
+					"File or dir to import",
+					scalar.Path(),
+					warg.Required(),
+				),
+			),
+			warg.NewSubCmd(
+				"prune",
+				"Delete orphaned links (links into src dirs whose targets don't exist)",
+				prune,
+				warg.CmdFlagMap(linkUnlinkFlags),
+				warg.CmdFlagMap(configFlags),
+			),
+			warg.NewSubCmd(
+				"status",
+				"Print what link would do without asking or changing anything. Exits 0 when fully linked, 2 when changes are pending, and 3 when there are errors",
+				status,
+				warg.CmdFlagMap(statusFlags),
+				warg.CmdFlagMap(configFlags),
+			),
+			warg.NewSubCmd(
+				"sync",
+				"Delete stale links into src dirs and create missing links",
+				syncCmd,
+				warg.CmdFlagMap(linkUnlinkFlags),
+				warg.CmdFlagMap(configFlags),
+				warg.CmdFlagMap(linkFlags),
+			),
+			warg.NewSubCmd(
+				"undo",
+				"Reverse a run recorded in the journal (see 'fling history')",
+				undoCmd,
+				warg.CmdFlagMap(warg.FlagMap{"--ask": linkUnlinkFlags["--ask"]}),
+				warg.NewCmdFlag(
+					"--run-id",
+					"ID of the run to undo. Defaults to the most recent run",
+					scalar.String(),
+				),
 			),
 			warg.SectionFooter("Homepage: https://github.com/bbkane/fling"),
 		),
@@ -76,7 +291,42 @@ func app() *warg.App {
 	return &app
 }
 
+// exitCodeError makes fling exit with code instead of 1. err is printed if it isn't nil.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit code %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// main is app().MustRun(), except that actions can return an exitCodeError
 func main() {
 	app := app()
-	app.MustRun()
+	pr, err := app.Parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		// EX_USAGE, like MustRun
+		os.Exit(64)
+	}
+	err = pr.Action(pr.Context)
+	var exitErr exitCodeError
+	if errors.As(err, &exitErr) {
+		if exitErr.err != nil {
+			fmt.Fprintln(os.Stderr, exitErr.err)
+		}
+		os.Exit(exitErr.code)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.bbkane.com/gocolor"
 )
 
 func TestBuildApp(t *testing.T) {
@@ -69,6 +76,28 @@ func createPreExisting(t testing.TB, p preExisting) (string, string) {
 	return srcDir, linkDir
 }
 
+// testFileInfoOpts returns the fileInfoOpts "fling link" would use
+func testFileInfoOpts(ignorePatterns []string, isDotfiles bool, onConflict string) fileInfoOpts {
+	compiled := make([]*regexp.Regexp, len(ignorePatterns))
+	for i, pattern := range ignorePatterns {
+		compiled[i] = regexp.MustCompile(pattern)
+	}
+	return fileInfoOpts{
+		ignorePatterns: compiled,
+		ignorePaths:    nil,
+		isDotfiles:     isDotfiles,
+		renameRules:    nil,
+		srcDirOpts:     nil,
+		onConflict:     onConflict,
+		machine:        machineFacts{os: "linux", host: "buildbox.example.com"},
+		templates:      nil,
+		scope:          nil,
+		noFolding:      false,
+		noFoldPaths:    nil,
+		unfold:         true,
+	}
+}
+
 func absPathExpectedFileInfo(srcDir string, linkDir string, fi *fileInfo) {
 
 	for i, d := range fi.dirLinksToCreate {
@@ -86,13 +115,18 @@ func absPathExpectedFileInfo(srcDir string, linkDir string, fi *fileInfo) {
 		fi.existingDirLinks[i].link = filepath.Join(linkDir, d.link)
 	}
 
+	for i, d := range fi.existingDirs {
+		fi.existingDirs[i].src = filepath.Join(srcDir, d.src)
+		fi.existingDirs[i].link = filepath.Join(linkDir, d.link)
+	}
+
 	for i, f := range fi.existingFileLinks {
 		fi.existingFileLinks[i].src = filepath.Join(srcDir, f.src)
 		fi.existingFileLinks[i].link = filepath.Join(linkDir, f.link)
 	}
 
 	for i, f := range fi.ignoredPaths {
-		fi.ignoredPaths[i] = ignoredPath(filepath.Join(srcDir, string(f)))
+		fi.ignoredPaths[i].path = filepath.Join(srcDir, f.path)
 	}
 
 }
@@ -120,12 +154,22 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: nil,
 			isDotFiles:     false,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  nil,
 				fileLinksToCreate: nil,
+				identicalFiles:    nil,
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      nil,
 				existingFileLinks: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
 				pathErrs:          nil,
 				pathsErrs:         nil,
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
 				ignoredPaths:      nil,
 			},
 			expectedErr: false,
@@ -142,12 +186,22 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: nil,
 			isDotFiles:     false,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  nil,
 				fileLinksToCreate: []linkT{{src: "file.txt", link: "file.txt"}},
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      nil,
 				existingFileLinks: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
 				pathErrs:          nil,
 				pathsErrs:         nil,
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				identicalFiles:    nil,
 				ignoredPaths:      nil,
 			},
 			expectedErr: false,
@@ -166,15 +220,25 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: nil,
 			isDotFiles:     false,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  nil,
 				fileLinksToCreate: nil,
+				identicalFiles:    nil,
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      nil,
 				existingFileLinks: []linkT{
 					{src: "file.txt", link: "file.txt"},
 				},
-				pathErrs:     nil,
-				pathsErrs:    nil,
-				ignoredPaths: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
+				pathErrs:          nil,
+				pathsErrs:         nil,
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				ignoredPaths:      nil,
 			},
 			expectedErr: false,
 		},
@@ -190,13 +254,23 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: []string{"README.*"},
 			isDotFiles:     true,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  []linkT{{src: "bin_common", link: "bin_common"}},
 				fileLinksToCreate: nil,
+				identicalFiles:    nil,
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      nil,
 				existingFileLinks: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
 				pathErrs:          nil,
 				pathsErrs:         nil,
-				ignoredPaths:      []ignoredPath{"README.md"},
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				ignoredPaths:      []ignoredPath{{path: "README.md", reason: "ignore pattern README.*"}},
 			},
 			expectedErr: false,
 		},
@@ -212,13 +286,23 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: []string{"README.*"},
 			isDotFiles:     true,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  nil,
 				fileLinksToCreate: nil,
+				identicalFiles:    nil,
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  []linkT{{src: "bin_common", link: "bin_common"}},
+				existingDirs:      nil,
 				existingFileLinks: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
 				pathErrs:          nil,
 				pathsErrs:         nil,
-				ignoredPaths:      []ignoredPath{"README.md"},
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				ignoredPaths:      []ignoredPath{{path: "README.md", reason: "ignore pattern README.*"}},
 			},
 			expectedErr: false,
 		},
@@ -234,16 +318,26 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: []string{"README.*"},
 			isDotFiles:     true,
 			expectedFileInfo: fileInfo{
+				chosenAlternates: nil,
 				dirLinksToCreate: nil,
 				fileLinksToCreate: []linkT{
 					{src: "dot-config/file.txt", link: ".config/file.txt"},
 					{src: "dot-gitconfig", link: ".gitconfig"},
 				},
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      []linkT{{src: "dot-config", link: ".config"}},
 				existingFileLinks: nil,
+				orphanedLinks:     nil,
+				outOfScope:        nil,
 				pathErrs:          nil,
 				pathsErrs:         nil,
-				ignoredPaths:      []ignoredPath{"README.md"},
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				identicalFiles:    nil,
+				ignoredPaths:      []ignoredPath{{path: "README.md", reason: "ignore pattern README.*"}},
 			},
 			expectedErr: false,
 		},
@@ -262,16 +356,26 @@ func TestBuildFileInfo(t *testing.T) {
 			ignorePatterns: []string{"README.*"},
 			isDotFiles:     true,
 			expectedFileInfo: fileInfo{
+				chosenAlternates:  nil,
 				dirLinksToCreate:  nil,
 				fileLinksToCreate: nil,
+				identicalFiles:    nil,
+				dirsToCreate:      nil,
+				dirsToUnfold:      nil,
 				existingDirLinks:  nil,
+				existingDirs:      []linkT{{src: "dot-config", link: ".config"}},
 				existingFileLinks: []linkT{
 					{src: "dot-config/file.txt", link: ".config/file.txt"},
 					{src: "dot-gitconfig", link: ".gitconfig"},
 				},
-				pathErrs:     nil,
-				pathsErrs:    nil,
-				ignoredPaths: []ignoredPath{"README.md"},
+				orphanedLinks:     nil,
+				outOfScope:        nil,
+				pathErrs:          nil,
+				pathsErrs:         nil,
+				pathsToAdopt:      nil,
+				pathsToBackup:     nil,
+				templatesToRender: nil,
+				ignoredPaths:      []ignoredPath{{path: "README.md", reason: "ignore pattern README.*"}},
 			},
 			expectedErr: false,
 		},
@@ -285,7 +389,7 @@ func TestBuildFileInfo(t *testing.T) {
 
 			absPathExpectedFileInfo(srcDir, linkDir, &tt.expectedFileInfo)
 
-			actualFileInfo, actualErr := buildCombinedFileInfo([]string{srcDir}, linkDir, tt.ignorePatterns, tt.isDotFiles)
+			actualFileInfo, actualErr := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(tt.ignorePatterns, tt.isDotFiles, "error"))
 
 			if tt.expectedErr {
 				require.Error(t, actualErr)
@@ -358,20 +462,30 @@ func TestBuildCombinedFileInfo(t *testing.T) {
 			nil, nil,
 		)
 
-		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, nil, false)
+		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, testFileInfoOpts(nil, false, "error"))
 		require.NoError(t, err)
 
 		expected := &fileInfo{
+			chosenAlternates:  nil,
 			dirLinksToCreate:  nil,
+			dirsToCreate:      nil,
+			dirsToUnfold:      nil,
 			existingDirLinks:  nil,
+			existingDirs:      nil,
 			existingFileLinks: nil,
 			fileLinksToCreate: []linkT{
 				{src: filepath.Join(srcDirs[0], "file1.txt"), link: filepath.Join(linkDir, "file1.txt")},
 				{src: filepath.Join(srcDirs[1], "file2.txt"), link: filepath.Join(linkDir, "file2.txt")},
 			},
-			ignoredPaths: nil,
-			pathErrs:     nil,
-			pathsErrs:    nil,
+			identicalFiles:    nil,
+			ignoredPaths:      nil,
+			orphanedLinks:     nil,
+			outOfScope:        nil,
+			pathErrs:          nil,
+			pathsErrs:         nil,
+			pathsToAdopt:      nil,
+			pathsToBackup:     nil,
+			templatesToRender: nil,
 		}
 		require.Equal(t, expected, actualFileInfo)
 	})
@@ -388,20 +502,27 @@ func TestBuildCombinedFileInfo(t *testing.T) {
 			nil, nil,
 		)
 
-		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, nil, false)
+		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, testFileInfoOpts(nil, false, "error"))
 		require.NoError(t, err)
 
 		linkPath := filepath.Join(linkDir, "conflict.txt")
 		expected := &fileInfo{
+			chosenAlternates:  nil,
 			dirLinksToCreate:  nil,
+			dirsToCreate:      nil,
+			dirsToUnfold:      nil,
 			existingDirLinks:  nil,
+			existingDirs:      nil,
 			existingFileLinks: nil,
 			fileLinksToCreate: []linkT{
 				{src: filepath.Join(srcDirs[0], "unique1.txt"), link: filepath.Join(linkDir, "unique1.txt")},
 				{src: filepath.Join(srcDirs[1], "unique2.txt"), link: filepath.Join(linkDir, "unique2.txt")},
 			},
-			ignoredPaths: nil,
-			pathErrs:     nil,
+			identicalFiles: nil,
+			ignoredPaths:   nil,
+			orphanedLinks:  nil,
+			outOfScope:     nil,
+			pathErrs:       nil,
 			pathsErrs: []pathsErr{
 				{
 					src:  filepath.Join(srcDirs[0], "conflict.txt"),
@@ -414,6 +535,9 @@ func TestBuildCombinedFileInfo(t *testing.T) {
 					err:  errors.New("link path conflict between src dirs"),
 				},
 			},
+			pathsToAdopt:      nil,
+			pathsToBackup:     nil,
+			templatesToRender: nil,
 		}
 		require.Equal(t, expected, actualFileInfo)
 	})
@@ -430,16 +554,23 @@ func TestBuildCombinedFileInfo(t *testing.T) {
 			nil, nil,
 		)
 
-		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, nil, false)
+		actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, testFileInfoOpts(nil, false, "error"))
 		require.NoError(t, err)
 
 		linkPath := filepath.Join(linkDir, "mydir")
 		expected := &fileInfo{
+			chosenAlternates:  nil,
 			dirLinksToCreate:  nil,
+			dirsToCreate:      nil,
+			dirsToUnfold:      nil,
 			existingDirLinks:  nil,
+			existingDirs:      nil,
 			existingFileLinks: nil,
 			fileLinksToCreate: nil,
+			identicalFiles:    nil,
 			ignoredPaths:      nil,
+			orphanedLinks:     nil,
+			outOfScope:        nil,
 			pathErrs:          nil,
 			pathsErrs: []pathsErr{
 				{
@@ -453,7 +584,1958 @@ func TestBuildCombinedFileInfo(t *testing.T) {
 					err:  errors.New("link path conflict between src dirs"),
 				},
 			},
+			pathsToAdopt:      nil,
+			pathsToBackup:     nil,
+			templatesToRender: nil,
 		}
 		require.Equal(t, expected, actualFileInfo)
 	})
 }
+
+func TestBuildFileInfoRelativeLinks(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dir"},
+			srcChildFiles:  []string{"file.txt", "dir/file.txt"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+
+	for _, name := range []string{"file.txt", "dir"} {
+		link := filepath.Join(linkDir, name)
+		target, err := symlinkTarget(filepath.Join(srcDir, name), link, "relative")
+		require.NoError(t, err)
+		require.False(t, filepath.IsAbs(target))
+		err = os.Symlink(target, link)
+		require.NoError(t, err)
+	}
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, false, "error"))
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates: nil,
+		dirLinksToCreate: nil,
+		dirsToCreate:     nil,
+		dirsToUnfold:     nil,
+		existingDirLinks: []linkT{
+			{src: filepath.Join(srcDir, "dir"), link: filepath.Join(linkDir, "dir")},
+		},
+		existingDirs: nil,
+		existingFileLinks: []linkT{
+			{src: filepath.Join(srcDir, "file.txt"), link: filepath.Join(linkDir, "file.txt")},
+		},
+		fileLinksToCreate: nil,
+		identicalFiles:    nil,
+		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+}
+
+func TestSymlinkTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		src         string
+		link        string
+		linkStyle   string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:        "absolute",
+			src:         "/home/me/dotfiles/dot-zshrc",
+			link:        "/home/me/.zshrc",
+			linkStyle:   "absolute",
+			expected:    "/home/me/dotfiles/dot-zshrc",
+			expectedErr: false,
+		},
+		{
+			name:        "relative",
+			src:         "/home/me/dotfiles/dot-config/nvim",
+			link:        "/home/me/.config/nvim",
+			linkStyle:   "relative",
+			expected:    "../dotfiles/dot-config/nvim",
+			expectedErr: false,
+		},
+		{
+			name:        "invalid",
+			src:         "/home/me/dotfiles/dot-zshrc",
+			link:        "/home/me/.zshrc",
+			linkStyle:   "sideways",
+			expected:    "",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := symlinkTarget(tt.src, tt.link, tt.linkStyle)
+			if tt.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expected, actual)
+		})
+	}
+
+	// relative targets are relative to the physical dir the link is in, even when the
+	// link dir (or a dir that doesn't exist yet in it) is under a symlinked dir
+	t.Run("symlinked parent", func(t *testing.T) {
+		t.Parallel()
+
+		dir := canonicalDir(t.TempDir())
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "deep", "real"), 0755))
+		require.NoError(t, os.Symlink(filepath.Join(dir, "deep", "real"), filepath.Join(dir, "home")))
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "src"), 0755))
+		src := filepath.Join(dir, "src", "f")
+		require.NoError(t, os.WriteFile(src, []byte("hello\n"), 0644))
+
+		for _, link := range []string{filepath.Join(dir, "home", "f"), filepath.Join(dir, "home", "new", "f")} {
+			target, err := symlinkTarget(src, link, "relative")
+			require.NoError(t, err)
+			require.Equal(t, src, resolveLinkTarget(link, target))
+			require.NoError(t, os.MkdirAll(filepath.Dir(link), 0755))
+			require.NoError(t, os.Symlink(target, link))
+			_, err = os.Stat(link)
+			require.NoError(t, err, "link is dangling")
+		}
+	})
+}
+
+func TestBuildFileInfoStowStyleLinks(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"dot-sqliterc", "file.txt"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	tmpDir := filepath.Dir(linkDir)
+
+	// reach linkDir through a symlinked parent so the relative targets only
+	// resolve correctly against the physical directory, like GNU Stow links do
+	aliasParent := filepath.Join(tmpDir, "alias")
+	err := os.Mkdir(aliasParent, 0755)
+	require.NoError(t, err)
+	aliasLinkDir := filepath.Join(aliasParent, "link")
+	err = os.Symlink(linkDir, aliasLinkDir)
+	require.NoError(t, err)
+
+	err = os.Symlink(filepath.Join("..", "src", "dot-sqliterc"), filepath.Join(linkDir, ".sqliterc"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join("..", "src", "..", "src", "file.txt"), filepath.Join(linkDir, "file.txt"))
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, aliasLinkDir, testFileInfoOpts(nil, true, "error"))
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates: nil,
+		dirLinksToCreate: nil,
+		dirsToCreate:     nil,
+		dirsToUnfold:     nil,
+		existingDirLinks: nil,
+		existingDirs:     nil,
+		existingFileLinks: []linkT{
+			{src: filepath.Join(srcDir, "dot-sqliterc"), link: filepath.Join(aliasLinkDir, ".sqliterc")},
+			{src: filepath.Join(srcDir, "file.txt"), link: filepath.Join(aliasLinkDir, "file.txt")},
+		},
+		fileLinksToCreate: nil,
+		identicalFiles:    nil,
+		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+}
+
+func TestAdopt(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"dot-bashrc", "dot-vim", "dot-profile"},
+			linkChildDirs:  []string{".vim"},
+			linkChildFiles: []string{".bashrc"},
+			links:          nil,
+		},
+	)
+	err := os.WriteFile(filepath.Join(linkDir, ".bashrc"), []byte("adopt me\n"), 0644)
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, true, "adopt"))
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates:  nil,
+		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: []linkT{
+			{src: filepath.Join(srcDir, "dot-profile"), link: filepath.Join(linkDir, ".profile")},
+		},
+		identicalFiles: nil,
+		ignoredPaths:   nil,
+		orphanedLinks:  nil,
+		outOfScope:     nil,
+		pathErrs:       nil,
+		pathsErrs:      nil,
+		pathsToAdopt: []linkT{
+			{src: filepath.Join(srcDir, "dot-bashrc"), link: filepath.Join(linkDir, ".bashrc")},
+			{src: filepath.Join(srcDir, "dot-vim"), link: filepath.Join(linkDir, ".vim")},
+		},
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+
+	ops, err := linkOps(actualFileInfo, "absolute")
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filepath.Join(srcDir, "dot-bashrc"))
+	require.NoError(t, err)
+	require.Equal(t, "adopt me\n", string(content))
+
+	srcVimInfo, err := os.Stat(filepath.Join(srcDir, "dot-vim"))
+	require.NoError(t, err)
+	require.True(t, srcVimInfo.IsDir())
+
+	target, err := os.Readlink(filepath.Join(linkDir, ".bashrc"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "dot-bashrc"), target)
+}
+
+func TestBackup(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"dot-bashrc", "dot-profile"},
+			linkChildDirs:  nil,
+			linkChildFiles: []string{".bashrc"},
+			links:          nil,
+		},
+	)
+	err := os.WriteFile(filepath.Join(linkDir, ".bashrc"), []byte("distro default\n"), 0644)
+	require.NoError(t, err)
+	foreignTarget := filepath.Join(filepath.Dir(linkDir), "elsewhere")
+	err = os.Symlink(foreignTarget, filepath.Join(linkDir, ".profile"))
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, true, "backup"))
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates:  nil,
+		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: nil,
+		identicalFiles:    nil,
+		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup: []linkT{
+			{src: filepath.Join(srcDir, "dot-bashrc"), link: filepath.Join(linkDir, ".bashrc")},
+			{src: filepath.Join(srcDir, "dot-profile"), link: filepath.Join(linkDir, ".profile")},
+		},
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+
+	// a backup made in the same second as an earlier one doesn't replace it
+	link := filepath.Join(linkDir, ".bashrc")
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	earlier, err := backupPath(link, now)
+	require.NoError(t, err)
+	require.Equal(t, link+".fling-bak.20250102T030405", earlier)
+	err = os.WriteFile(earlier, []byte("earlier backup\n"), 0644)
+	require.NoError(t, err)
+	backup, err := backupPath(link, now)
+	require.NoError(t, err)
+	require.Equal(t, link+".fling-bak.20250102T030405-2", backup)
+
+	// only backups the manifest records are restored, not every <link>.fling-bak.* file
+	links := []linkT{{src: filepath.Join(srcDir, "dot-bashrc"), link: link}}
+	opts := testFileInfoOpts(nil, true, "backup")
+	m := &manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+	ltd, err := planDeleteLinks(linkDir, links, opts, m, true)
+	require.NoError(t, err)
+	require.Empty(t, ltd.backupsToRestore)
+
+	ops := []op{
+		newRenameOp(link, backup),
+		newCreateLinkOp(link, filepath.Join(srcDir, "dot-bashrc")),
+	}
+	err = m.update(ops, []string{srcDir}, "20250102T030405")
+	require.NoError(t, err)
+	require.Equal(t, []manifestBackup{{Link: link, Backup: backup, Run: "20250102T030405"}}, m.Backups)
+	err = os.WriteFile(backup, []byte("distro default\n"), 0644)
+	require.NoError(t, err)
+	ltd, err = planDeleteLinks(linkDir, links, opts, m, true)
+	require.NoError(t, err)
+	require.Equal(t, []backupToRestore{{backup: backup, link: link}}, ltd.backupsToRestore)
+
+	// a recorded backup that's gone is an error
+	err = os.Remove(backup)
+	require.NoError(t, err)
+	_, err = planDeleteLinks(linkDir, links, opts, m, true)
+	require.ErrorContains(t, err, backup)
+
+	// restoring the backup forgets it
+	err = m.update([]op{newRemoveLinkOp(link, filepath.Join(srcDir, "dot-bashrc")), newRenameOp(backup, link)}, nil, "")
+	require.NoError(t, err)
+	require.Empty(t, m.Backups)
+}
+
+func TestIdenticalFiles(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"dot-bashrc", "dot-profile"},
+			linkChildDirs:  nil,
+			linkChildFiles: []string{".bashrc", ".profile"},
+			links:          nil,
+		},
+	)
+	err := os.WriteFile(filepath.Join(linkDir, ".profile"), []byte("different\n"), 0644)
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, true, "error"))
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates:  nil,
+		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: nil,
+		identicalFiles: []linkT{
+			{src: filepath.Join(srcDir, "dot-bashrc"), link: filepath.Join(linkDir, ".bashrc")},
+		},
+		ignoredPaths:  nil,
+		orphanedLinks: nil,
+		outOfScope:    nil,
+		pathErrs: []pathErr{
+			{path: filepath.Join(linkDir, ".profile"), err: errors.New("linkPath is already an existing file")},
+		},
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+
+	link := filepath.Join(linkDir, ".bashrc")
+	err = replaceWithLink(filepath.Join(srcDir, "dot-bashrc"), link)
+	require.NoError(t, err)
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "dot-bashrc"), target)
+}
+
+func TestUnfoldRefold(t *testing.T) {
+	t.Parallel()
+
+	srcDirs, linkDir := createPreExistingMulti(
+		t,
+		[]srcSetup{
+			{childDirs: []string{"dot-config"}, childFiles: []string{"dot-config/a.txt"}},
+			{childDirs: []string{"dot-config"}, childFiles: []string{"dot-config/b.txt"}},
+		},
+		nil, nil,
+	)
+	configLink := filepath.Join(linkDir, ".config")
+	err := os.Symlink(filepath.Join(srcDirs[0], "dot-config"), configLink)
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo(srcDirs, linkDir, testFileInfoOpts(nil, true, "error"))
+	require.NoError(t, err)
+
+	aLink := linkT{src: filepath.Join(srcDirs[0], "dot-config", "a.txt"), link: filepath.Join(configLink, "a.txt")}
+	bLink := linkT{src: filepath.Join(srcDirs[1], "dot-config", "b.txt"), link: filepath.Join(configLink, "b.txt")}
+	expected := &fileInfo{
+		chosenAlternates: nil,
+		dirLinksToCreate: nil,
+		dirsToCreate:     nil,
+		dirsToUnfold: []linkT{
+			{src: filepath.Join(srcDirs[0], "dot-config"), link: configLink},
+		},
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: []linkT{aLink, bLink},
+		identicalFiles:    nil,
+		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+
+	// apply the plan
+	ops, err := linkOps(actualFileInfo, "absolute")
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	// only dirs the manifest records fling unfolded are refolded
+	m := &manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+	noRefolds, err := planRefolds(linkDir, []linkT{bLink}, testFileInfoOpts(nil, true, "error"), m)
+	require.NoError(t, err)
+	require.Empty(t, noRefolds)
+
+	// and only into the dir they were unfolded from
+	m.setDir(manifestDir{Path: configLink, UnfoldedFrom: filepath.Join(srcDirs[1], "dot-config")})
+	noRefolds, err = planRefolds(linkDir, []linkT{bLink}, testFileInfoOpts(nil, true, "error"), m)
+	require.NoError(t, err)
+	require.Empty(t, noRefolds)
+
+	// unlinking only the second src dir leaves a dir that can be folded back into a link
+	err = m.update(ops, srcDirs, "")
+	require.NoError(t, err)
+	require.Equal(t, []manifestDir{{Path: configLink, UnfoldedFrom: expected.dirsToUnfold[0].src}}, m.Dirs)
+	dirsToRefold, err := planRefolds(linkDir, []linkT{bLink}, testFileInfoOpts(nil, true, "error"), m)
+	require.NoError(t, err)
+	// canonicalDir because the temp dir might be behind a symlink (like /var on MacOS)
+	require.Equal(t, []linkT{{src: canonicalDir(filepath.Join(srcDirs[0], "dot-config")), link: configLink}}, dirsToRefold)
+
+	// but not when unlinking both
+	noRefolds, err = planRefolds(linkDir, []linkT{aLink, bLink}, testFileInfoOpts(nil, true, "error"), m)
+	require.NoError(t, err)
+	require.Empty(t, noRefolds)
+
+	ltd, err := planDeleteLinks(linkDir, []linkT{bLink}, testFileInfoOpts(nil, true, "error"), m, false)
+	require.NoError(t, err)
+	require.Equal(t, dirsToRefold, ltd.dirsToRefold)
+	ops, err = unlinkOps(ltd)
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+	target, err := os.Readlink(configLink)
+	require.NoError(t, err)
+	require.Equal(t, canonicalDir(filepath.Join(srcDirs[0], "dot-config")), target)
+}
+
+func TestNoFolding(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config", "dot-config/nvim"},
+			srcChildFiles:  []string{"dot-zshrc", "dot-config/nvim/init.lua"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFolding = true
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+
+	dirsToCreate := []linkT{
+		{src: filepath.Join(srcDir, "dot-config"), link: filepath.Join(linkDir, ".config")},
+		{src: filepath.Join(srcDir, "dot-config", "nvim"), link: filepath.Join(linkDir, ".config", "nvim")},
+	}
+	fileLinks := []linkT{
+		{src: filepath.Join(srcDir, "dot-config", "nvim", "init.lua"), link: filepath.Join(linkDir, ".config", "nvim", "init.lua")},
+		{src: filepath.Join(srcDir, "dot-zshrc"), link: filepath.Join(linkDir, ".zshrc")},
+	}
+	expected := &fileInfo{
+		chosenAlternates:  nil,
+		dirLinksToCreate:  nil,
+		dirsToCreate:      dirsToCreate,
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: fileLinks,
+		identicalFiles:    nil,
+		ignoredPaths:      nil,
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+
+	for _, e := range dirsToCreate {
+		err = os.Mkdir(e.link, 0755)
+		require.NoError(t, err)
+	}
+	for _, e := range fileLinks {
+		err = os.Symlink(e.src, e.link)
+		require.NoError(t, err)
+	}
+
+	// only dirs the manifest records fling created are deleted
+	m := &manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+	emptyDirsToDelete, err := planEmptyDirDeletes(linkDir, fileLinks, opts, m)
+	require.NoError(t, err)
+	require.Empty(t, emptyDirsToDelete)
+
+	for _, e := range dirsToCreate {
+		m.setDir(manifestDir{Path: e.link, UnfoldedFrom: ""})
+	}
+	emptyDirsToDelete, err = planEmptyDirDeletes(linkDir, fileLinks, opts, m)
+	require.NoError(t, err)
+	require.Equal(t, dirsToCreate, emptyDirsToDelete)
+
+	// a file the link dir's owner added keeps its dirs around
+	err = os.WriteFile(filepath.Join(linkDir, ".config", "cache.txt"), []byte("cache\n"), 0644)
+	require.NoError(t, err)
+	emptyDirsToDelete, err = planEmptyDirDeletes(linkDir, fileLinks, opts, m)
+	require.NoError(t, err)
+	require.Equal(t, dirsToCreate[1:], emptyDirsToDelete)
+}
+
+func TestNoFoldPathsAndMarkers(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-local", "dot-local/share", "dot-local/share/fonts", "dot-ssh", "dot-vim"},
+			srcChildFiles:  []string{"dot-local/share/fonts/font.ttf", "dot-ssh/config", "dot-ssh/" + noFoldMarker, "dot-vim/vimrc"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFoldPaths = []string{".local/share"}
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+
+	expected := &fileInfo{
+		chosenAlternates: nil,
+		dirLinksToCreate: []linkT{
+			{src: filepath.Join(srcDir, "dot-local", "share", "fonts"), link: filepath.Join(linkDir, ".local", "share", "fonts")},
+			{src: filepath.Join(srcDir, "dot-vim"), link: filepath.Join(linkDir, ".vim")},
+		},
+		dirsToCreate: []linkT{
+			{src: filepath.Join(srcDir, "dot-local"), link: filepath.Join(linkDir, ".local")},
+			{src: filepath.Join(srcDir, "dot-local", "share"), link: filepath.Join(linkDir, ".local", "share")},
+			{src: filepath.Join(srcDir, "dot-ssh"), link: filepath.Join(linkDir, ".ssh")},
+		},
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: nil,
+		fileLinksToCreate: []linkT{
+			{src: filepath.Join(srcDir, "dot-ssh", "config"), link: filepath.Join(linkDir, ".ssh", "config")},
+		},
+		identicalFiles:    nil,
+		ignoredPaths:      []ignoredPath{{path: filepath.Join(srcDir, "dot-ssh", noFoldMarker), reason: "no-fold marker file"}},
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         nil,
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	require.Equal(t, expected, actualFileInfo)
+}
+
+func TestUnlinkKeepsPreExistingNoFoldDirs(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config", "dot-ssh"},
+			srcChildFiles:  []string{"dot-config/app.toml", "dot-ssh/config"},
+			linkChildDirs:  []string{".ssh"},
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+
+	// the default --no-fold-path
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFoldPaths = []string{".config", ".local/share", ".ssh"}
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	// fling creates .config, but .ssh was there first
+	require.Equal(t, []linkT{{src: filepath.Join(srcDir, "dot-config"), link: filepath.Join(linkDir, ".config")}}, fi.dirsToCreate)
+
+	m := &manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+	for _, e := range fi.dirsToCreate {
+		err = os.Mkdir(e.link, 0755)
+		require.NoError(t, err)
+		m.setDir(manifestDir{Path: e.link, UnfoldedFrom: ""})
+	}
+	for _, e := range fi.fileLinksToCreate {
+		err = os.Symlink(e.src, e.link)
+		require.NoError(t, err)
+	}
+
+	emptyDirsToDelete, err := planEmptyDirDeletes(linkDir, fi.fileLinksToCreate, opts, m)
+	require.NoError(t, err)
+	require.Equal(t, []emptyDirToDelete{{src: filepath.Join(srcDir, "dot-config"), link: filepath.Join(linkDir, ".config")}}, emptyDirsToDelete)
+}
+
+func TestSyncStaleLinks(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"docs"},
+			srcChildFiles:  []string{"a", "b", "README.md", "docs/guide.md"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			// "a" was renamed from "b", "old" was deleted
+			links: []linkT{
+				{src: "b", link: "a"},
+				{src: "b", link: "b"},
+				{src: "old", link: "old"},
+			},
+		},
+	)
+	// links to ignored paths were made by hand, not by fling, so they're left alone
+	for _, l := range []linkT{{src: "README.md", link: "README.md"}, {src: "docs/guide.md", link: "guide.md"}} {
+		err := os.Symlink(filepath.Join(srcDir, l.src), filepath.Join(linkDir, l.link))
+		require.NoError(t, err)
+	}
+
+	opts := testFileInfoOpts([]string{"README.*", "^docs$"}, false, "error")
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Len(t, fi.pathsErrs, 1)
+
+	staleLinks, err := findStaleLinks([]string{linkDir}, []string{srcDir}, fi)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]linkT{
+			{src: filepath.Join(canonicalDir(srcDir), "b"), link: filepath.Join(linkDir, "a")},
+			{src: filepath.Join(canonicalDir(srcDir), "old"), link: filepath.Join(linkDir, "old")},
+		},
+		staleLinks,
+	)
+
+	err = replaceStaleLinks(fi, staleLinks, linkDir, opts)
+	require.NoError(t, err)
+	require.Nil(t, fi.pathsErrs)
+	require.Equal(
+		t,
+		[]linkT{{src: filepath.Join(srcDir, "a"), link: filepath.Join(linkDir, "a")}},
+		fi.fileLinksToCreate,
+	)
+}
+
+func TestOrphanedLinks(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dir"},
+			srcChildFiles:  []string{"a", "dir/b"},
+			linkChildDirs:  []string{"dir"},
+			linkChildFiles: nil,
+			links: []linkT{
+				{src: "a", link: "a"},
+				{src: "dir/b", link: "dir/b"},
+				{src: "gone", link: "gone"},
+				{src: "dir/gone", link: "dir/gone"},
+			},
+		},
+	)
+	// links outside the src dir aren't fling's business
+	err := os.Symlink(filepath.Join(linkDir, "missing"), filepath.Join(linkDir, "other"))
+	require.NoError(t, err)
+
+	actualFileInfo, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, false, "error"))
+	require.NoError(t, err)
+
+	require.Equal(
+		t,
+		[]orphanedLink{
+			{src: filepath.Join(canonicalDir(srcDir), "dir", "gone"), link: filepath.Join(linkDir, "dir", "gone")},
+			{src: filepath.Join(canonicalDir(srcDir), "gone"), link: filepath.Join(linkDir, "gone")},
+		},
+		actualFileInfo.orphanedLinks,
+	)
+	require.Nil(t, actualFileInfo.pathsErrs)
+}
+
+func TestStatusExitCode(t *testing.T) {
+	t.Parallel()
+
+	emptyFileInfo := func() *fileInfo {
+		return &fileInfo{
+			chosenAlternates:  nil,
+			dirLinksToCreate:  nil,
+			dirsToCreate:      nil,
+			dirsToUnfold:      nil,
+			existingDirLinks:  nil,
+			existingDirs:      nil,
+			existingFileLinks: nil,
+			fileLinksToCreate: nil,
+			identicalFiles:    nil,
+			ignoredPaths:      nil,
+			orphanedLinks:     nil,
+			outOfScope:        nil,
+			pathErrs:          nil,
+			pathsErrs:         nil,
+			pathsToAdopt:      nil,
+			pathsToBackup:     nil,
+			templatesToRender: nil,
+		}
+	}
+
+	linked := emptyFileInfo()
+	linked.existingFileLinks = []linkT{{src: "src/a", link: "link/a"}}
+	require.Equal(t, statusExitLinked, statusExitCode(linked))
+
+	pending := emptyFileInfo()
+	pending.fileLinksToCreate = []linkT{{src: "src/a", link: "link/a"}}
+	require.Equal(t, statusExitPending, statusExitCode(pending))
+
+	orphaned := emptyFileInfo()
+	orphaned.orphanedLinks = []linkT{{src: "src/gone", link: "link/gone"}}
+	require.Equal(t, statusExitPending, statusExitCode(orphaned))
+
+	errs := emptyFileInfo()
+	errs.fileLinksToCreate = []linkT{{src: "src/a", link: "link/a"}}
+	errs.pathsErrs = []pathsErr{{src: "src/b", link: "link/b", err: errors.New("linkPath is already an existing file")}}
+	require.Equal(t, statusExitErrors, statusExitCode(errs))
+}
+
+func TestNewJSONFileInfo(t *testing.T) {
+	t.Parallel()
+
+	fi := &fileInfo{
+		chosenAlternates:  nil,
+		dirLinksToCreate:  nil,
+		dirsToCreate:      nil,
+		dirsToUnfold:      nil,
+		existingDirLinks:  nil,
+		existingDirs:      nil,
+		existingFileLinks: []linkT{{src: "src/a", link: "link/a"}},
+		fileLinksToCreate: nil,
+		identicalFiles:    nil,
+		ignoredPaths:      []ignoredPath{{path: "src/README.md", reason: "ignore pattern README.*"}},
+		orphanedLinks:     nil,
+		outOfScope:        nil,
+		pathErrs:          nil,
+		pathsErrs:         []pathsErr{{src: "src/b", link: "link/b", err: errors.New("linkPath is already an existing file")}},
+		pathsToAdopt:      nil,
+		pathsToBackup:     nil,
+		templatesToRender: nil,
+	}
+	doc := jsonDoc{
+		Version:       jsonVersion,
+		Command:       "link",
+		FileInfo:      newJSONFileInfo(fi),
+		LinksToDelete: nil,
+		Outcome:       outcomeErrors,
+		RolledBack:    []op{},
+		Error:         "resolve errors above before creating links",
+	}
+	actual, err := json.Marshal(doc)
+	require.NoError(t, err)
+
+	expected := `{
+		"version": 1,
+		"command": "link",
+		"fileInfo": {
+			"chosenAlternates": [],
+			"dirLinksToCreate": [],
+			"dirsToCreate": [],
+			"dirsToUnfold": [],
+			"existingDirLinks": [],
+			"existingDirs": [],
+			"existingFileLinks": [{"src": "src/a", "link": "link/a"}],
+			"fileLinksToCreate": [],
+			"identicalFiles": [],
+			"ignoredPaths": ["src/README.md"],
+			"ignoredPathReasons": [{"path": "src/README.md", "reason": "ignore pattern README.*"}],
+			"orphanedLinks": [],
+			"outOfScope": [],
+			"pathErrs": [],
+			"pathsErrs": [{"src": "src/b", "link": "link/b", "error": "linkPath is already an existing file"}],
+			"pathsToAdopt": [],
+			"pathsToBackup": [],
+			"templatesToRender": []
+		},
+		"outcome": "errors",
+		"rolledBack": [],
+		"error": "resolve errors above before creating links"
+	}`
+	require.JSONEq(t, expected, string(actual))
+}
+
+func TestLockFile(t *testing.T) {
+	t.Parallel()
+
+	p := filepath.Join(t.TempDir(), "manifest.lock")
+	unlock, err := lockFile(p)
+	require.NoError(t, err)
+
+	locked := make(chan error)
+	go func() {
+		unlockAgain, err := lockFile(p)
+		if err == nil {
+			unlockAgain()
+		}
+		locked <- err
+	}()
+	select {
+	case err = <-locked:
+		t.Fatalf("got the lock while it was held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	require.NoError(t, <-locked)
+}
+
+func TestJSONPlanningError(t *testing.T) {
+	t.Parallel()
+
+	_, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  nil,
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	missing := filepath.Join(t.TempDir(), "missing")
+	_, planErr := buildCombinedFileInfo([]string{missing}, linkDir, testFileInfoOpts(nil, false, "error"))
+	require.Error(t, planErr)
+
+	// the error is reported in the JSON document, with no plan
+	color, err := gocolor.Prepare(false)
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	r := newReporter(formatJSON, &color, "link")
+	r.stdout = &stdout
+	err = r.finish(outcomeErrors, planErr)
+	require.Equal(t, planErr, err)
+
+	expected := fmt.Sprintf(`{
+		"version": 1,
+		"command": "link",
+		"fileInfo": null,
+		"outcome": "errors",
+		"rolledBack": [],
+		"error": %q
+	}`, planErr.Error())
+	require.JSONEq(t, expected, stdout.String())
+}
+
+func TestCheckOps(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"a", "b"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          []linkT{{src: "b", link: "old"}},
+		},
+	)
+
+	a := filepath.Join(linkDir, "a")
+	b := filepath.Join(linkDir, "b")
+	old := filepath.Join(linkDir, "old")
+	ops := []op{
+		newCreateLinkOp(a, filepath.Join(srcDir, "a")),
+		// paths freed by earlier ops can be reused by later ones
+		newRemoveLinkOp(old, filepath.Join(srcDir, "b")),
+		newCreateLinkOp(old, filepath.Join(srcDir, "a")),
+		newMkdirOp(b, 0755),
+		newCreateLinkOp(filepath.Join(b, "b"), filepath.Join(srcDir, "b")),
+	}
+	require.NoError(t, checkOps(ops))
+
+	// but not if the filesystem changed after planning
+	err := os.WriteFile(a, []byte("surprise\n"), 0644)
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.ErrorContains(t, err, "create_link "+a+": path already exists")
+	// so nothing was applied
+	target, err := os.Readlink(old)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "b"), target)
+
+	err = os.Remove(a)
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+	target, err = os.Readlink(old)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "a"), target)
+	_, err = os.Readlink(filepath.Join(b, "b"))
+	require.NoError(t, err)
+
+	// dirs with entries can't be removed
+	require.ErrorContains(t, checkOps([]op{newRemoveDirOp(b)}), "dir is not empty")
+
+	// renames are checked to stay on one filesystem, using the closest dir that already exists
+	newDir := filepath.Join(linkDir, "new")
+	require.Equal(t, linkDir, closestExisting(filepath.Join(newDir, "a")))
+	require.NoError(t, checkOps([]op{newMkdirOp(newDir, 0755), newRenameOp(filepath.Join(srcDir, "a"), filepath.Join(newDir, "a"))}))
+}
+
+func TestPlanFile(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	p := filepath.Join(tmpDir, "plan.json")
+	ops := []op{
+		newMkdirOp("link/dir", 0755),
+		newCreateLinkOp("link/dir/a", "src/dir/a"),
+		newRenameOp("link/b", "link/b.fling-bak.20250101T000000"),
+	}
+	err := writePlanFile(p, "link", []string{"src"}, "link", ops)
+	require.NoError(t, err)
+
+	pf, err := readPlanFile(p)
+	require.NoError(t, err)
+	require.Equal(t, &planFile{Version: planVersion, Command: "link", SrcDirs: []string{"src"}, LinkDir: "link", Ops: ops}, pf)
+
+	err = os.WriteFile(p, []byte(`{"version": 999, "command": "link", "ops": []}`), 0644)
+	require.NoError(t, err)
+	_, err = readPlanFile(p)
+	require.ErrorContains(t, err, "unsupported plan version 999")
+}
+
+func TestRollback(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"a", "b"},
+			linkChildDirs:  []string{"empty"},
+			linkChildFiles: []string{"identical"},
+			links:          []linkT{{src: "b", link: "old"}},
+		},
+	)
+	adoptMe := filepath.Join(linkDir, "adopt-me")
+	err := os.WriteFile(adoptMe, []byte("adopt me\n"), 0600)
+	require.NoError(t, err)
+
+	ops := []op{
+		newMkdirOp(filepath.Join(linkDir, "new"), 0755),
+		newCreateLinkOp(filepath.Join(linkDir, "new", "a"), filepath.Join(srcDir, "a")),
+		newRemoveLinkOp(filepath.Join(linkDir, "old"), filepath.Join(srcDir, "b")),
+		newRemoveDirOp(filepath.Join(linkDir, "empty")),
+		newRemoveFileOp(filepath.Join(srcDir, "b")),
+		newRenameOp(adoptMe, filepath.Join(srcDir, "b")),
+		newReplaceWithLinkOp(filepath.Join(linkDir, "identical"), filepath.Join(srcDir, "a"), filepath.Join(srcDir, "a")),
+	}
+	require.NoError(t, checkOps(ops))
+
+	tx := opTx{applied: nil}
+	for _, o := range ops {
+		err = tx.apply(o)
+		require.NoError(t, err)
+	}
+	rolledBack, err := tx.rollback()
+	require.NoError(t, err)
+	mostRecentFirst := slices.Clone(ops)
+	// applying remembers the modes of what's replaced, so it can be restored
+	mostRecentFirst[3].Mode = 0755
+	mostRecentFirst[6].Mode = 0644
+	slices.Reverse(mostRecentFirst)
+	require.Equal(t, mostRecentFirst, rolledBack)
+
+	_, err = os.Lstat(filepath.Join(linkDir, "new"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	target, err := os.Readlink(filepath.Join(linkDir, "old"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "b"), target)
+	emptyInfo, err := os.Stat(filepath.Join(linkDir, "empty"))
+	require.NoError(t, err)
+	require.True(t, emptyInfo.IsDir())
+	content, err := os.ReadFile(filepath.Join(srcDir, "b"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(content))
+	content, err = os.ReadFile(adoptMe)
+	require.NoError(t, err)
+	require.Equal(t, "adopt me\n", string(content))
+	identicalInfo, err := os.Lstat(filepath.Join(linkDir, "identical"))
+	require.NoError(t, err)
+	require.True(t, identicalInfo.Mode().IsRegular())
+	require.Equal(t, os.FileMode(0644), identicalInfo.Mode().Perm())
+	_, err = os.Lstat(trashPath(filepath.Join(srcDir, "b")))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// interrupting before the first op leaves everything as it was
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = applyOps(ctx, ops)
+	var rbErr *rollbackError
+	require.ErrorAs(t, err, &rbErr)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Empty(t, rbErr.rolledBack)
+	_, err = os.Lstat(filepath.Join(linkDir, "new"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "journal")
+	runs, err := readRuns(dir)
+	require.NoError(t, err)
+	require.Empty(t, runs)
+
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	newRun := func(command string, undoes string) *journalRun {
+		return &journalRun{
+			Version: journalVersion,
+			ID:      "",
+			Time:    now,
+			Argv:    []string{"fling", command},
+			Command: command,
+			SrcDirs: []string{"src"},
+			LinkDir: "link",
+			Undoes:  undoes,
+			Ops:     []op{newCreateLinkOp("link/a", "src/a")},
+		}
+	}
+	first := newRun("link", "")
+	err = recordRun(dir, first)
+	require.NoError(t, err)
+	require.Equal(t, "20250102T030405", first.ID)
+	// runs in the same second don't overwrite each other
+	second := newRun("undo", first.ID)
+	err = recordRun(dir, second)
+	require.NoError(t, err)
+	require.Equal(t, "20250102T030405-2", second.ID)
+
+	runs, err = readRuns(dir)
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	require.Equal(t, first.ID, runs[0].ID)
+	require.Equal(t, second.ID, runs[1].ID)
+	require.Equal(t, map[string]string{first.ID: second.ID}, undoneBy(runs))
+}
+
+func TestUndoOps(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"a", "b"},
+			linkChildDirs:  nil,
+			linkChildFiles: []string{"identical", "in-the-way"},
+			links:          []linkT{{src: "b", link: "old"}},
+		},
+	)
+
+	inTheWay := filepath.Join(linkDir, "in-the-way")
+	backup, err := backupPath(inTheWay, time.Now())
+	require.NoError(t, err)
+	ops := []op{
+		newMkdirOp(filepath.Join(linkDir, "new"), 0700),
+		newCreateLinkOp(filepath.Join(linkDir, "new", "a"), filepath.Join(srcDir, "a")),
+		newRemoveLinkOp(filepath.Join(linkDir, "old"), filepath.Join(srcDir, "b")),
+		newRenameOp(inTheWay, backup),
+		newCreateLinkOp(inTheWay, filepath.Join(srcDir, "b")),
+		newReplaceWithLinkOp(filepath.Join(linkDir, "identical"), filepath.Join(srcDir, "a"), filepath.Join(srcDir, "a")),
+	}
+	applied, err := applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	undo, notUndoable := undoOps(applied)
+	require.Empty(t, notUndoable)
+	_, err = applyOps(t.Context(), undo)
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(linkDir)
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	require.Equal(t, []string{"identical", "in-the-way", "old"}, names)
+	target, err := os.Readlink(filepath.Join(linkDir, "old"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(srcDir, "b"), target)
+	for _, name := range []string{"identical", "in-the-way"} {
+		info, err := os.Lstat(filepath.Join(linkDir, name))
+		require.NoError(t, err)
+		require.True(t, info.Mode().IsRegular())
+	}
+
+	// removed files can't be brought back
+	_, notUndoable = undoOps([]op{newRemoveFileOp(filepath.Join(srcDir, "a"))})
+	require.Equal(t, []op{newRemoveFileOp(filepath.Join(srcDir, "a"))}, notUndoable)
+}
+
+func TestManifest(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"a", "b"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	otherSrcDir := filepath.Join(filepath.Dir(srcDir), "other")
+	err := os.Mkdir(otherSrcDir, 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(otherSrcDir, "a"), []byte("other\n"), 0644)
+	require.NoError(t, err)
+
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, false, "error"))
+	require.NoError(t, err)
+	ops, err := linkOps(fi, "relative")
+	require.NoError(t, err)
+	applied, err := applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	p := filepath.Join(t.TempDir(), "state", "manifest.json")
+	m, err := readManifest(p)
+	require.NoError(t, err)
+	require.Empty(t, m.Links)
+	err = m.update(applied, []string{srcDir}, "")
+	require.NoError(t, err)
+	err = writeManifest(p, m)
+	require.NoError(t, err)
+	m, err = readManifest(p)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]manifestLink{
+			{Link: filepath.Join(linkDir, "a"), Target: filepath.Join("..", "src", "a"), Src: filepath.Join(canonicalDir(srcDir), "a"), SrcDir: srcDir},
+			{Link: filepath.Join(linkDir, "b"), Target: filepath.Join("..", "src", "b"), Src: filepath.Join(canonicalDir(srcDir), "b"), SrcDir: srcDir},
+		},
+		m.Links,
+	)
+
+	// linking the same path from another src dir says where the link came from
+	otherFi, err := buildCombinedFileInfo([]string{otherSrcDir}, linkDir, testFileInfoOpts(nil, false, "error"))
+	require.NoError(t, err)
+	require.Len(t, otherFi.pathsErrs, 1)
+	annotateManifestConflicts(otherFi, m, []string{otherSrcDir})
+	require.ErrorContains(t, otherFi.pathsErrs[0].err, "fling linked it from --src-dir "+srcDir)
+
+	// the manifest still knows the links after the src dir is gone
+	err = os.RemoveAll(srcDir)
+	require.NoError(t, err)
+	links, err := manifestLinksIn(m, []string{linkDir}, nil)
+	require.NoError(t, err)
+	require.Equal(t, m.Links, links)
+	links, err = manifestLinksIn(m, []string{linkDir}, []string{otherSrcDir})
+	require.NoError(t, err)
+	require.Empty(t, links)
+
+	// links changed without fling are forgotten
+	err = os.Remove(filepath.Join(linkDir, "b"))
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(linkDir, "b"), []byte("mine\n"), 0644)
+	require.NoError(t, err)
+	m.forgetMoved()
+	require.Len(t, m.Links, 1)
+
+	ltd, err := planDeleteLinks(linkDir, []linkT{{src: m.Links[0].Src, link: m.Links[0].Link}}, testFileInfoOpts(nil, false, "error"), m, false)
+	require.NoError(t, err)
+	ops, err = unlinkOps(ltd)
+	require.NoError(t, err)
+	applied, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+	err = m.update(applied, nil, "")
+	require.NoError(t, err)
+	require.Empty(t, m.Links)
+	_, err = os.Lstat(filepath.Join(linkDir, "a"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, configFileName)
+	cfg, errs := parseConfig(p, []byte(`packages:
+  home:
+    src: home
+    linkDir: /link
+  work:
+    src: /work
+    linkDir: /link
+    ignore: ["^cache$"]
+    dotfiles: false
+    rename: ["suffix:.symlink:", "regex/^_(.*)$/.$1"]
+`))
+	require.Empty(t, errs)
+	require.Equal(
+		t,
+		[]configPackage{
+			{name: "home", src: filepath.Join(dir, "home"), srcLine: 3, linkDir: "/link", ignorePatterns: []string{"README.*"}, isDotfiles: true, renameRules: []string{}},
+			{name: "work", src: "/work", srcLine: 6, linkDir: "/link", ignorePatterns: []string{"^cache$"}, isDotfiles: false, renameRules: []string{"suffix:.symlink:", "regex/^_(.*)$/.$1"}},
+		},
+		cfg.packages,
+	)
+
+	pkgs, err := cfg.selectPackages([]string{"work"})
+	require.NoError(t, err)
+	require.Equal(t, []configPackage{cfg.packages[1]}, pkgs)
+	_, err = cfg.selectPackages([]string{"nope"})
+	require.Error(t, err)
+
+	_, errs = parseConfig(p, []byte(`packages:
+  home:
+    src: home
+    lnkDir: /link
+  work:
+    ignore: ["("]
+    dotfiles: maybe
+    rename: ["infix:a:b"]
+  home:
+    src: other
+extra: 1
+`))
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	require.Equal(
+		t,
+		[]string{
+			p + ":11:1: unknown key in config: extra (expected one of [packages])",
+			p + ":9:3: duplicate key in packages: home",
+			p + ":4:5: unknown key in package home: lnkDir (expected one of [src linkDir ignore dotfiles rename])",
+			p + ":6:14: invalid package work ignore pattern: error parsing regexp: missing closing ): `(`",
+			p + ":7:15: package work dotfiles must be true or false",
+			p + ":8:14: package work: invalid rename rule (expected it to start with prefix, suffix, or regex, then a separator, like prefix:dot-:.): \"infix:a:b\"",
+			p + ":6:5: package work is missing src",
+		},
+		msgs,
+	)
+
+	_, errs = parseConfig(p, []byte(`packages:
+  home:
+    src: /work
+  copy:
+    src: /work/
+`))
+	require.Len(t, errs, 1)
+	require.EqualError(t, errs[0], p+":5:10: package copy src is already package home src: /work")
+
+	_, errs = parseConfig(p, []byte(""))
+	require.Len(t, errs, 1)
+
+	// packages set their own dotfiles, ignore, and rename, so the flags can't override them
+	require.NoError(t, checkPackageOverrides(true, defaultIgnorePatterns(), nil, p))
+	require.EqualError(
+		t,
+		checkPackageOverrides(false, []string{"^cache$"}, []string{"prefix:_:."}, p),
+		"--dotfiles, --ignore, --rename can't be used with the packages in "+p+", since each package sets its own dotfiles, ignore, and rename. Set them in the config file or pass --src-dir instead",
+	)
+}
+
+func TestFindConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "a", "b")
+	err := os.MkdirAll(nested, 0755)
+	require.NoError(t, err)
+
+	p, err := findConfig(nested)
+	require.NoError(t, err)
+	require.Empty(t, p)
+
+	err = os.WriteFile(filepath.Join(dir, configFileName), []byte("packages: {}\n"), 0644)
+	require.NoError(t, err)
+	p, err = findConfig(nested)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, configFileName), p)
+}
+
+func TestSrcDirOpts(t *testing.T) {
+	t.Parallel()
+
+	srcDirs, linkDir := createPreExistingMulti(
+		t,
+		[]srcSetup{
+			{childDirs: nil, childFiles: []string{"dot-a", "README.md"}},
+			{childDirs: nil, childFiles: []string{"dot-b", "README.txt"}},
+		},
+		nil,
+		nil,
+	)
+	opts := testFileInfoOpts([]string{"README.*"}, true, "error")
+	// src2's package doesn't map dot- names or ignore READMEs
+	opts.srcDirOpts = map[string]srcDirOpts{
+		srcDirs[1]: {linkDir: linkDir, ignorePatterns: nil, isDotfiles: false, renameRules: nil},
+	}
+	fi, err := buildCombinedFileInfo(srcDirs, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDirs[0], "dot-a"), link: filepath.Join(linkDir, ".a")},
+			{src: filepath.Join(srcDirs[1], "README.txt"), link: filepath.Join(linkDir, "README.txt")},
+			{src: filepath.Join(srcDirs[1], "dot-b"), link: filepath.Join(linkDir, "dot-b")},
+		},
+		fi.fileLinksToCreate,
+	)
+	require.Equal(t, []ignoredPath{{path: filepath.Join(srcDirs[0], "README.md"), reason: "ignore pattern README.*"}}, fi.ignoredPaths)
+}
+
+func TestSrcDirLinkDirPairs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		arg     string
+		srcDir  string
+		linkDir string
+		isPair  bool
+	}{
+		{arg: "src", srcDir: "src", linkDir: "", isPair: false},
+		{arg: "src:/link", srcDir: "src", linkDir: "/link", isPair: true},
+		{arg: "src:", srcDir: "src", linkDir: "", isPair: true},
+	} {
+		srcDir, linkDir, isPair := splitSrcDirArg(tc.arg)
+		require.Equal(t, tc.srcDir, srcDir, tc.arg)
+		require.Equal(t, tc.linkDir, linkDir, tc.arg)
+		require.Equal(t, tc.isPair, isPair, tc.arg)
+	}
+
+	// a src dir with a ':' in its name isn't a pair
+	colonDir := filepath.Join(t.TempDir(), "src:backup")
+	err := os.Mkdir(colonDir, 0755)
+	require.NoError(t, err)
+	srcDir, linkDir, isPair := splitSrcDirArg(colonDir)
+	require.Equal(t, colonDir, srcDir)
+	require.Empty(t, linkDir)
+	require.False(t, isPair)
+
+	srcDirs, linkDir := createPreExistingMulti(
+		t,
+		[]srcSetup{
+			{childDirs: []string{"etc"}, childFiles: []string{"a", "etc/b"}},
+			{childDirs: nil, childFiles: []string{"a", "c"}},
+			{childDirs: nil, childFiles: []string{"a"}},
+		},
+		nil,
+		nil,
+	)
+	pairOpts := func(linkDirs ...string) fileInfoOpts {
+		opts := testFileInfoOpts(nil, false, "error")
+		opts.srcDirOpts = make(map[string]srcDirOpts)
+		for i, ld := range linkDirs {
+			opts.srcDirOpts[srcDirs[i]] = srcDirOpts{linkDir: ld, ignorePatterns: nil, isDotfiles: false, renameRules: nil}
+		}
+		return opts
+	}
+
+	// each src dir is planned against its own link dir
+	home, etc := filepath.Join(linkDir, "home"), filepath.Join(linkDir, "etc")
+	fi, err := buildCombinedFileInfo(srcDirs[:2], linkDir, pairOpts(home, etc))
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDirs[1], "a"), link: filepath.Join(etc, "a")},
+			{src: filepath.Join(srcDirs[1], "c"), link: filepath.Join(etc, "c")},
+			{src: filepath.Join(srcDirs[0], "a"), link: filepath.Join(home, "a")},
+		},
+		fi.fileLinksToCreate,
+	)
+	require.Empty(t, fi.pathsErrs)
+
+	// link path conflicts are still found across pairs
+	fi, err = buildCombinedFileInfo([]string{srcDirs[1], srcDirs[2]}, linkDir, pairOpts("", home, home))
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]pathsErr{
+			{src: filepath.Join(srcDirs[1], "a"), link: filepath.Join(home, "a"), err: errors.New("link path conflict between src dirs")},
+			{src: filepath.Join(srcDirs[2], "a"), link: filepath.Join(home, "a"), err: errors.New("link path conflict between src dirs")},
+		},
+		fi.pathsErrs,
+	)
+
+	// a dir link can't contain another pair's link dir
+	fi, err = buildCombinedFileInfo(srcDirs[:2], linkDir, pairOpts(linkDir, etc))
+	require.NoError(t, err)
+	require.Empty(t, fi.dirLinksToCreate)
+	require.Len(t, fi.pathsErrs, 1)
+	require.Equal(t, filepath.Join(linkDir, "etc"), fi.pathsErrs[0].link)
+}
+
+func TestAlternates(t *testing.T) {
+	t.Parallel()
+
+	m := machineFacts{os: "linux", host: "buildbox.example.com"}
+	for _, tc := range []struct {
+		names  []string
+		chosen string
+		reason string
+	}{
+		{names: []string{"a##default", "a##os.linux"}, chosen: "a##os.linux", reason: "os is linux"},
+		{names: []string{"a##os.linux", "a##host.buildbox"}, chosen: "a##host.buildbox", reason: "host is buildbox.example.com"},
+		{names: []string{"a##host.buildbox", "a##host.buildbox,os.linux"}, chosen: "a##host.buildbox,os.linux", reason: "host is buildbox.example.com and os is linux"},
+		{names: []string{"a", "a##os.darwin"}, chosen: "a", reason: "no alternate matches this machine"},
+		{names: []string{"a##os.darwin", "a##host.other"}, chosen: "", reason: ""},
+	} {
+		chosen, reason, err := chooseAlternate("a", tc.names, m)
+		require.NoError(t, err)
+		require.Equal(t, tc.chosen, chosen, tc.names)
+		require.Equal(t, tc.reason, reason, tc.names)
+	}
+	_, _, err := chooseAlternate("a", []string{"a##os.linux", "a##os.Linux"}, m)
+	require.Error(t, err)
+	_, _, err = chooseAlternate("a", []string{"a##arch.amd64"}, m)
+	require.Error(t, err)
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config##os.darwin", "dot-config##default"},
+			srcChildFiles:  []string{"dot-gitconfig##os.linux", "dot-gitconfig##default", "dot-config##default/x"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, testFileInfoOpts(nil, true, "error"))
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]chosenAlternate{
+			{src: filepath.Join(srcDir, "dot-config##default"), link: filepath.Join(linkDir, ".config"), reason: "default"},
+			{src: filepath.Join(srcDir, "dot-gitconfig##os.linux"), link: filepath.Join(linkDir, ".gitconfig"), reason: "os is linux"},
+		},
+		fi.chosenAlternates,
+	)
+	require.Equal(t, []dirLinkToCreate{{src: filepath.Join(srcDir, "dot-config##default"), link: filepath.Join(linkDir, ".config")}}, fi.dirLinksToCreate)
+	require.Equal(t, []fileLinkToCreate{{src: filepath.Join(srcDir, "dot-gitconfig##os.linux"), link: filepath.Join(linkDir, ".gitconfig")}}, fi.fileLinksToCreate)
+	require.Equal(
+		t,
+		[]ignoredPath{
+			{path: filepath.Join(srcDir, "dot-config##os.darwin"), reason: "not the alternate chosen for this machine"},
+			{path: filepath.Join(srcDir, "dot-gitconfig##default"), reason: "not the alternate chosen for this machine"},
+		},
+		fi.ignoredPaths,
+	)
+
+	// children of a real dir for an alternate link under the name without the ##suffix
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFolding = true
+	fi, err = buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDir, "dot-config##default", "x"), link: filepath.Join(linkDir, ".config", "x")},
+			{src: filepath.Join(srcDir, "dot-gitconfig##os.linux"), link: filepath.Join(linkDir, ".gitconfig")},
+		},
+		fi.fileLinksToCreate,
+	)
+}
+
+func TestTemplates(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   nil,
+			srcChildFiles:  []string{"dot-gitconfig.tmpl", "typo.tmpl"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "dot-gitconfig.tmpl"), []byte("{{ .OS }} {{ .Data.email }}\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "typo.tmpl"), []byte("{{ .Data.emial }}\n"), 0644))
+
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.templates = &templateOpts{
+		generatedDir: t.TempDir(),
+		data: templateData{
+			Hostname: "buildbox.example.com",
+			OS:       "linux",
+			User:     "me",
+			Home:     "/home/me",
+			Env:      map[string]string{},
+			Data:     map[string]any{"email": "me@example.com"},
+		},
+	}
+	src := filepath.Join(srcDir, "dot-gitconfig.tmpl")
+	generated := generatedPath(opts.templates.generatedDir, src)
+	require.Equal(t, filepath.Join(opts.templates.generatedDir, srcDir, "dot-gitconfig"), generated)
+
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(t, []templateToRender{{src: src, generated: generated, content: "linux me@example.com\n", mode: 0644}}, fi.templatesToRender)
+	require.Equal(t, []fileLinkToCreate{{src: generated, link: filepath.Join(linkDir, ".gitconfig")}}, fi.fileLinksToCreate)
+	require.Len(t, fi.pathErrs, 1)
+	require.Equal(t, filepath.Join(srcDir, "typo.tmpl"), fi.pathErrs[0].path)
+
+	ops, err := linkOps(fi, "absolute")
+	require.NoError(t, err)
+	require.Equal(t, opWriteFile, ops[0].Kind)
+	require.Equal(t, contentHash("linux me@example.com\n"), ops[0].Hash)
+
+	// plans only save the hash, so their templates are rendered again before applying them
+	data, err := json.Marshal(ops)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "me@example.com")
+	var planned []op
+	err = json.Unmarshal(data, &planned)
+	require.NoError(t, err)
+	require.ErrorContains(t, checkOps(planned), "renders differently than when planned")
+	err = renderWriteFiles(planned, opts.templates)
+	require.NoError(t, err)
+	require.NoError(t, checkOps(planned))
+	changed := *opts.templates
+	changed.data.Data = map[string]any{"email": "other@example.com"}
+	err = renderWriteFiles(planned, &changed)
+	require.NoError(t, err)
+	require.ErrorContains(t, checkOps(planned), "renders differently than when planned")
+
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(linkDir, ".gitconfig"))
+	require.NoError(t, err)
+	require.Equal(t, "linux me@example.com\n", string(content))
+
+	// nothing to render until the data changes
+	fi, err = buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Empty(t, fi.templatesToRender)
+	require.Equal(t, []existingFileLink{{src: generated, link: filepath.Join(linkDir, ".gitconfig")}}, fi.existingFileLinks)
+
+	opts.templates.data.Data["email"] = "me@example.org"
+	fi, err = buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(t, []templateToRender{{src: src, generated: generated, content: "linux me@example.org\n", mode: 0644}}, fi.templatesToRender)
+	require.Equal(t, []existingFileLink{{src: generated, link: filepath.Join(linkDir, ".gitconfig")}}, fi.existingFileLinks)
+	ops, err = linkOps(fi, "absolute")
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+	content, err = os.ReadFile(filepath.Join(linkDir, ".gitconfig"))
+	require.NoError(t, err)
+	require.Equal(t, "linux me@example.org\n", string(content))
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		{pattern: "*.log", path: "a/b/x.log", isDir: false, matches: true},
+		{pattern: "/x.log", path: "a/x.log", isDir: false, matches: false},
+		{pattern: "/x.log", path: "x.log", isDir: false, matches: true},
+		{pattern: "cache/", path: "a/cache", isDir: true, matches: true},
+		{pattern: "cache/", path: "a/cache", isDir: false, matches: false},
+		{pattern: "a/*/c", path: "a/b/c", isDir: false, matches: true},
+		{pattern: "a/*/c", path: "a/b/b/c", isDir: false, matches: false},
+		{pattern: "a/**/c", path: "a/c", isDir: false, matches: true},
+		{pattern: "a/**/c", path: "a/b/b/c", isDir: false, matches: true},
+		{pattern: "**/c", path: "a/b/c", isDir: false, matches: true},
+		{pattern: "a/**", path: "a/b/c", isDir: false, matches: true},
+		{pattern: "a/**", path: "a", isDir: true, matches: false},
+		{pattern: "dot-[!a]*", path: "dot-bashrc", isDir: false, matches: true},
+		{pattern: "dot-[!a]*", path: "dot-a", isDir: false, matches: false},
+		{pattern: `\#x`, path: "#x", isDir: false, matches: true},
+	} {
+		r, isRule, err := parseIgnoreRule("/r", "/r/"+ignoreFileName+":1", tc.pattern)
+		require.NoError(t, err)
+		require.True(t, isRule)
+		require.Equal(t, tc.matches, r.matches(filepath.Join("/r", filepath.FromSlash(tc.path)), tc.isDir), tc)
+	}
+	_, isRule, err := parseIgnoreRule("/r", "/r/"+ignoreFileName+":1", "# comment")
+	require.NoError(t, err)
+	require.False(t, isRule)
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs: []string{"dot-config", "dot-config/nvim", "dot-config/nvim/plugin"},
+			srcChildFiles: []string{
+				ignoreFileName, "README.md", "a.log", "keep.log",
+				"dot-config/nvim/" + ignoreFileName, "dot-config/nvim/init.lua", "dot-config/nvim/lazy-lock.json", "dot-config/nvim/plugin/x.lua",
+			},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	rootIgnore := filepath.Join(srcDir, ignoreFileName)
+	nvimIgnore := filepath.Join(srcDir, "dot-config", "nvim", ignoreFileName)
+	require.NoError(t, os.WriteFile(rootIgnore, []byte("# logs\n*.log\n!keep.log\n!README.md\n"), 0644))
+	require.NoError(t, os.WriteFile(nvimIgnore, []byte("lazy-lock.json\n/plugin/\n"), 0644))
+
+	opts := testFileInfoOpts([]string{"README.*"}, true, "error")
+	opts.noFolding = true
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]ignoredPath{
+			{path: rootIgnore, reason: "ignore file"},
+			{path: filepath.Join(srcDir, "a.log"), reason: rootIgnore + ":2: *.log"},
+			{path: nvimIgnore, reason: "ignore file"},
+			{path: filepath.Join(srcDir, "dot-config", "nvim", "lazy-lock.json"), reason: nvimIgnore + ":1: lazy-lock.json"},
+			{path: filepath.Join(srcDir, "dot-config", "nvim", "plugin"), reason: nvimIgnore + ":2: /plugin/"},
+		},
+		fi.ignoredPaths,
+	)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDir, "dot-config", "nvim", "init.lua"), link: filepath.Join(linkDir, ".config", "nvim", "init.lua")},
+			{src: filepath.Join(srcDir, "README.md"), link: filepath.Join(linkDir, "README.md")},
+			{src: filepath.Join(srcDir, "keep.log"), link: filepath.Join(linkDir, "keep.log")},
+		},
+		fi.fileLinksToCreate,
+	)
+
+	require.NoError(t, os.WriteFile(nvimIgnore, []byte("[abc\n"), 0644))
+	_, err = buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.ErrorContains(t, err, nvimIgnore+":1: invalid pattern")
+}
+
+func TestIgnorePaths(t *testing.T) {
+	t.Parallel()
+
+	_, err := compileIgnorePatterns([]string{"README.*", "("})
+	require.ErrorContains(t, err, "invalid --ignore pattern: (")
+	_, err = compilePathGlobs("--ignore-path", []string{"[abc"})
+	require.ErrorContains(t, err, "--ignore-path: invalid pattern: [abc")
+	_, err = compilePathGlobs("--ignore-path", []string{"!nvim"})
+	require.Error(t, err)
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"cache", "dot-config", "dot-config/app", "dot-config/app/cache", "nvim"},
+			srcChildFiles:  []string{"cache/a", "dot-config/app/cache/b", "dot-config/app/c", "nvim/init.lua", "nvim/lazy-lock.json"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFolding = true
+	opts.ignorePaths, err = compilePathGlobs("--ignore-path", []string{"dot-config/*/cache/", "nvim/lazy-lock.json"})
+	require.NoError(t, err)
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]ignoredPath{
+			{path: filepath.Join(srcDir, "dot-config", "app", "cache"), reason: "--ignore-path: dot-config/*/cache/"},
+			{path: filepath.Join(srcDir, "nvim", "lazy-lock.json"), reason: "--ignore-path: nvim/lazy-lock.json"},
+		},
+		fi.ignoredPaths,
+	)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDir, "dot-config", "app", "c"), link: filepath.Join(linkDir, ".config", "app", "c")},
+			{src: filepath.Join(srcDir, "cache", "a"), link: filepath.Join(linkDir, "cache", "a")},
+			{src: filepath.Join(srcDir, "nvim", "init.lua"), link: filepath.Join(linkDir, "nvim", "init.lua")},
+		},
+		fi.fileLinksToCreate,
+	)
+}
+
+func TestScope(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config", "dot-config/git", "dot-config/nvim"},
+			srcChildFiles:  []string{"dot-bashrc", "dot-config/git/config", "dot-config/nvim/init.lua"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          []linkT{{src: "dot-bashrc", link: ".bashrc"}},
+		},
+	)
+	config := linkT{src: filepath.Join(srcDir, "dot-config"), link: filepath.Join(linkDir, ".config")}
+	git := linkT{src: filepath.Join(srcDir, "dot-config", "git"), link: filepath.Join(linkDir, ".config", "git")}
+	nvim := linkT{src: filepath.Join(srcDir, "dot-config", "nvim"), link: filepath.Join(linkDir, ".config", "nvim")}
+	bashrc := linkT{src: filepath.Join(srcDir, "dot-bashrc"), link: filepath.Join(linkDir, ".bashrc")}
+
+	_, err := compilePathGlobs("--only", []string{"!dot-config"})
+	require.ErrorContains(t, err, "invalid --only pattern")
+
+	buildScoped := func(only []string, targets []string) *fileInfo {
+		opts := testFileInfoOpts(nil, true, "error")
+		opts.noFoldPaths = []string{".config"}
+		compiled, err := compilePathGlobs("--only", only)
+		require.NoError(t, err)
+		opts.scope = &scope{only: compiled, targets: targets}
+		fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+		require.NoError(t, err)
+		return fi
+	}
+
+	// a src path glob, a link path glob, and a link path target all pick nvim. .config
+	// stays in scope because nvim's link is created in it
+	for _, fi := range []*fileInfo{
+		buildScoped([]string{"dot-config/nvim"}, nil),
+		buildScoped([]string{".config/n*"}, nil),
+		buildScoped(nil, []string{nvim.link}),
+	} {
+		require.Equal(t, []dirToCreate{config}, fi.dirsToCreate)
+		require.Equal(t, []dirLinkToCreate{nvim}, fi.dirLinksToCreate)
+		require.Nil(t, fi.existingFileLinks)
+		require.Equal(t, []linkT{bashrc, git}, fi.outOfScope)
+	}
+
+	fi := buildScoped([]string{".bashrc"}, nil)
+	require.Nil(t, fi.dirsToCreate)
+	require.Nil(t, fi.dirLinksToCreate)
+	require.Equal(t, []existingFileLink{bashrc}, fi.existingFileLinks)
+	require.Equal(t, []linkT{config, git, nvim}, fi.outOfScope)
+	require.False(t, hasLinksToCreate(fi))
+}
+
+func TestScopeUnfold(t *testing.T) {
+	t.Parallel()
+
+	srcDirs, linkDir := createPreExistingMulti(
+		t,
+		[]srcSetup{
+			{childDirs: []string{"dot-config", "dot-config/git", "dot-config/nvim"}, childFiles: []string{"dot-config/git/config", "dot-config/nvim/init.lua"}},
+			{childDirs: []string{"dot-config"}, childFiles: []string{"dot-config/b.txt"}},
+		},
+		nil, nil,
+	)
+	configLink := filepath.Join(linkDir, ".config")
+	err := os.Symlink(filepath.Join(srcDirs[0], "dot-config"), configLink)
+	require.NoError(t, err)
+
+	opts := testFileInfoOpts(nil, true, "error")
+	compiled, err := compilePathGlobs("--only", []string{"dot-config/nvim"})
+	require.NoError(t, err)
+	opts.scope = &scope{only: compiled, targets: nil}
+	fi, err := buildCombinedFileInfo(srcDirs, linkDir, opts)
+	require.NoError(t, err)
+
+	// unfolding .config for nvim removes its link, so git and b.txt are linked again too
+	require.Equal(t, []dirToUnfold{{src: filepath.Join(srcDirs[0], "dot-config"), link: configLink}}, fi.dirsToUnfold)
+	require.Equal(
+		t,
+		[]dirLinkToCreate{
+			{src: filepath.Join(srcDirs[0], "dot-config", "git"), link: filepath.Join(configLink, "git")},
+			{src: filepath.Join(srcDirs[0], "dot-config", "nvim"), link: filepath.Join(configLink, "nvim")},
+		},
+		fi.dirLinksToCreate,
+	)
+	require.Equal(t, []fileLinkToCreate{{src: filepath.Join(srcDirs[1], "dot-config", "b.txt"), link: filepath.Join(configLink, "b.txt")}}, fi.fileLinksToCreate)
+	require.Nil(t, fi.outOfScope)
+}
+
+func TestRenameRules(t *testing.T) {
+	t.Parallel()
+
+	for _, text := range []string{"infix:a:b", "prefix", "prefix::.", "prefix:a:b:c", "regex:(:x"} {
+		_, err := parseRenameRule(text)
+		require.Error(t, err, text)
+	}
+
+	parsed, err := parseRenameRules([]string{"suffix:.symlink:", "regex|^_(.*)$|.$1"})
+	require.NoError(t, err)
+	rules := renameRules(slices.Concat([]renameRule{dotfilesRule()}, parsed))
+
+	tests := []struct {
+		src  string
+		link string
+	}{
+		{src: "dot-bashrc", link: ".bashrc"},
+		{src: "dot-vimrc.symlink", link: ".vimrc"},
+		{src: "_tmux.conf", link: ".tmux.conf"},
+		{src: "README.md", link: "README.md"},
+	}
+	for _, tt := range tests {
+		link, err := rules.linkName(tt.src)
+		require.NoError(t, err)
+		require.Equal(t, tt.link, link)
+	}
+
+	src, err := rules.srcName(".bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "dot-bashrc", src)
+	src, err = rules.srcName("README.md")
+	require.NoError(t, err)
+	require.Equal(t, "README.md", src)
+	// dot-x would be renamed to .x
+	_, err = rules.srcName("dot-x")
+	require.Error(t, err)
+	_, err = renameRules([]renameRule{dotfilesRule(), {text: "prefix:.:", kind: renamePrefix, from: ".", to: "", re: nil}}).linkName("dot-")
+	require.ErrorContains(t, err, "invalid name")
+
+	// rules apply to every component of the path, including dirs
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config.symlink", "dot-config.symlink/_nvim"},
+			srcChildFiles:  []string{"dot-config.symlink/_nvim/init.lua"},
+			linkChildDirs:  nil,
+			linkChildFiles: nil,
+			links:          nil,
+		},
+	)
+	opts := testFileInfoOpts(nil, true, "error")
+	opts.noFolding = true
+	opts.renameRules = parsed
+	fi, err := buildCombinedFileInfo([]string{srcDir}, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]fileLinkToCreate{
+			{src: filepath.Join(srcDir, "dot-config.symlink", "_nvim", "init.lua"), link: filepath.Join(linkDir, ".config", ".nvim", "init.lua")},
+		},
+		fi.fileLinksToCreate,
+	)
+}
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	srcDir, linkDir := createPreExisting(
+		t,
+		preExisting{
+			srcChildDirs:   []string{"dot-config"},
+			srcChildFiles:  []string{"dot-gitconfig"},
+			linkChildDirs:  []string{".config", ".config/app"},
+			linkChildFiles: []string{".config/app/settings", ".gitconfig", ".tmux.conf", "dot-x"},
+			links:          nil,
+		},
+	)
+	opts := testFileInfoOpts(nil, true, "error")
+	srcDirs := []string{srcDir}
+
+	plan, err := planImport(filepath.Join(linkDir, ".tmux.conf"), srcDirs, linkDir, opts)
+	require.NoError(t, err)
+	tmuxConf := pathToImport{src: filepath.Join(srcDir, "dot-tmux.conf"), link: filepath.Join(linkDir, ".tmux.conf")}
+	require.Equal(t, &importPlan{srcDir: srcDir, dirsToCreate: nil, path: tmuxConf}, plan)
+	ops, err := importOps(plan, "absolute")
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	plan, err = planImport(filepath.Join(linkDir, ".config", "app", "settings"), srcDirs, linkDir, opts)
+	require.NoError(t, err)
+	settings := pathToImport{src: filepath.Join(srcDir, "dot-config", "app", "settings"), link: filepath.Join(linkDir, ".config", "app", "settings")}
+	require.Equal(
+		t,
+		&importPlan{
+			srcDir:       srcDir,
+			dirsToCreate: []linkT{{src: filepath.Join(srcDir, "dot-config", "app"), link: filepath.Join(linkDir, ".config", "app")}},
+			path:         settings,
+		},
+		plan,
+	)
+	ops, err = importOps(plan, "absolute")
+	require.NoError(t, err)
+	_, err = applyOps(t.Context(), ops)
+	require.NoError(t, err)
+
+	// fling link finds the imported paths already linked
+	opts.noFoldPaths = []string{".config"}
+	fi, err := buildCombinedFileInfo(srcDirs, linkDir, opts)
+	require.NoError(t, err)
+	require.Equal(t, []existingFileLink{settings, tmuxConf}, fi.existingFileLinks)
+	content, err := os.ReadFile(tmuxConf.src)
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(content))
+
+	_, err = planImport(filepath.Join(linkDir, ".tmux.conf"), srcDirs, linkDir, opts)
+	require.ErrorContains(t, err, "path is a symlink")
+	_, err = planImport(filepath.Join(linkDir, ".gitconfig"), srcDirs, linkDir, opts)
+	require.ErrorContains(t, err, "src path already exists")
+	_, err = planImport(filepath.Join(linkDir, "dot-x"), srcDirs, linkDir, opts)
+	require.ErrorContains(t, err, "couldn't find the src name")
+	_, err = planImport(filepath.Join(srcDir, "dot-gitconfig"), srcDirs, linkDir, opts)
+	require.ErrorContains(t, err, "already in a src dir")
+	outside := filepath.Join(filepath.Dir(linkDir), "outside")
+	require.NoError(t, os.WriteFile(outside, []byte("hello\n"), 0644))
+	_, err = planImport(outside, srcDirs, linkDir, opts)
+	require.ErrorContains(t, err, "not in the link dir")
+	_, err = planImport(filepath.Join(linkDir, "missing"), srcDirs, linkDir, opts)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
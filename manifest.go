@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.bbkane.com/warg"
+)
+
+// manifestVersion is the version of the manifest file
+const manifestVersion = 1
+
+// manifestLink is a link fling created
+type manifestLink struct {
+	// Link is the absolute path of the link
+	Link string `json:"link"`
+	// Target is the symlink target fling wrote
+	Target string `json:"target"`
+	// Src is the absolute path Target points to
+	Src string `json:"src"`
+	// SrcDir is the absolute --src-dir Src was in, or "" if it wasn't in one
+	SrcDir string `json:"srcDir"`
+}
+
+// manifestDir is a real dir fling created that still exists
+type manifestDir struct {
+	// Path is the absolute path of the dir
+	Path string `json:"path"`
+	// UnfoldedFrom is the path the dir link fling replaced with this dir pointed to (see
+	// dirToUnfold), or "" if fling didn't create it by unfolding
+	UnfoldedFrom string `json:"unfoldedFrom,omitempty"`
+}
+
+// manifestBackup is a path fling backed up to make way for a link (see pathToBackup)
+type manifestBackup struct {
+	// Link is the absolute path that was backed up, where fling then put a link
+	Link string `json:"link"`
+	// Backup is the absolute path fling renamed it to
+	Backup string `json:"backup"`
+	// Run is the ID of the journal run that made the backup, or "" if the run wasn't recorded
+	Run string `json:"run"`
+}
+
+// manifest records the links fling created that are still where fling put them, across
+// every src dir and link dir. It lets unlink --manifest work without the src dirs,
+// and lets runs from different src dirs tell they target the same link path.
+// It also records the dirs fling created, so unlink only refolds or deletes those, and
+// the backups it made, so unlink --restore-backups only restores those.
+type manifest struct {
+	Version int `json:"version"`
+	// Links are sorted by Link
+	Links []manifestLink `json:"links"`
+	// Dirs are sorted by Path
+	Dirs []manifestDir `json:"dirs"`
+	// Backups are in the order fling made them
+	Backups []manifestBackup `json:"backups"`
+}
+
+// stateDir returns the dir fling keeps state in: $XDG_STATE_HOME/fling, or ~/.local/state/fling
+// See https://specifications.freedesktop.org/basedir-spec/latest/
+func stateDir() (string, error) {
+	// the spec says relative paths are invalid and should be ignored
+	if xdgStateHome := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(xdgStateHome) {
+		return filepath.Join(xdgStateHome, "fling"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find state dir: %w", err)
+	}
+	return filepath.Join(home, ".local", "state", "fling"), nil
+}
+
+func manifestPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "manifest.json"), nil
+}
+
+// readManifest reads the manifest at p. A missing manifest is empty.
+func readManifest(p string) (*manifest, error) {
+	m := manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read manifest: %w", err)
+	}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode manifest: %s: %w", p, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d (this fling supports version %d): %s", m.Version, manifestVersion, p)
+	}
+	return &m, nil
+}
+
+// writeManifest atomically replaces the manifest at p with m
+func writeManifest(p string, m *manifest) error {
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return fmt.Errorf("couldn't create manifest dir: %w", err)
+	}
+	if m.Links == nil {
+		m.Links = []manifestLink{}
+	}
+	if m.Dirs == nil {
+		m.Dirs = []manifestDir{}
+	}
+	if m.Backups == nil {
+		m.Backups = []manifestBackup{}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode manifest: %w", err)
+	}
+	tmp := p + ".fling-tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't write manifest: %w", err)
+	}
+	err = os.Rename(tmp, p)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("couldn't write manifest: %w", err)
+	}
+	return nil
+}
+
+func (m *manifest) search(link string) (int, bool) {
+	return slices.BinarySearchFunc(m.Links, link, func(e manifestLink, link string) int {
+		return cmp.Compare(e.Link, link)
+	})
+}
+
+// find returns the manifest entry for the link at the absolute path link
+func (m *manifest) find(link string) (manifestLink, bool) {
+	i, found := m.search(link)
+	if !found {
+		return manifestLink{Link: "", Target: "", Src: "", SrcDir: ""}, false
+	}
+	return m.Links[i], true
+}
+
+func (m *manifest) set(ml manifestLink) {
+	i, found := m.search(ml.Link)
+	if found {
+		m.Links[i] = ml
+		return
+	}
+	m.Links = slices.Insert(m.Links, i, ml)
+}
+
+func (m *manifest) remove(link string) {
+	i, found := m.search(link)
+	if found {
+		m.Links = slices.Delete(m.Links, i, i+1)
+	}
+}
+
+func (m *manifest) searchDir(p string) (int, bool) {
+	return slices.BinarySearchFunc(m.Dirs, p, func(e manifestDir, p string) int {
+		return cmp.Compare(e.Path, p)
+	})
+}
+
+// findDir returns the manifest entry for the dir fling created at the absolute path p
+func (m *manifest) findDir(p string) (manifestDir, bool) {
+	i, found := m.searchDir(p)
+	if !found {
+		return manifestDir{Path: "", UnfoldedFrom: ""}, false
+	}
+	return m.Dirs[i], true
+}
+
+func (m *manifest) setDir(md manifestDir) {
+	i, found := m.searchDir(md.Path)
+	if found {
+		m.Dirs[i] = md
+		return
+	}
+	m.Dirs = slices.Insert(m.Dirs, i, md)
+}
+
+func (m *manifest) removeDir(p string) {
+	i, found := m.searchDir(p)
+	if found {
+		m.Dirs = slices.Delete(m.Dirs, i, i+1)
+	}
+}
+
+// latestBackup returns the last backup fling made of the absolute path link
+func (m *manifest) latestBackup(link string) (manifestBackup, bool) {
+	for _, mb := range slices.Backward(m.Backups) {
+		if mb.Link == link {
+			return mb, true
+		}
+	}
+	return manifestBackup{Link: "", Backup: "", Run: ""}, false
+}
+
+// srcDirOf returns the src dir (made absolute) that src is in, or "" if it's in none
+func srcDirOf(src string, srcDirs []string) string {
+	for _, dir := range srcDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		if isUnderDir(canonicalPath(src), canonicalDir(absDir)) {
+			return absDir
+		}
+	}
+	return ""
+}
+
+// update records the links, dirs and backups applied ops created and forgets the ones they
+// removed. srcDirs are the src dirs of the run that applied ops, and run is its journal ID.
+func (m *manifest) update(ops []op, srcDirs []string, run string) error {
+	// where the dir links removed so far pointed, to tell which mkdirs unfold them
+	removedLinks := make(map[string]string)
+	for _, o := range ops {
+		p, err := filepath.Abs(o.Path)
+		if err != nil {
+			return fmt.Errorf("couldn't make path absolute: %w", err)
+		}
+		switch o.Kind {
+		case opCreateLink, opReplaceWithLink:
+			src := resolveLinkTarget(p, o.Target)
+			m.set(manifestLink{
+				Link:   p,
+				Target: o.Target,
+				Src:    src,
+				SrcDir: srcDirOf(src, srcDirs),
+			})
+		case opRemoveLink:
+			m.remove(p)
+			removedLinks[p] = resolveLinkTarget(p, o.Target)
+		case opReplaceWithCopy:
+			m.remove(p)
+		case opRename:
+			// a renamed link or dir (like a backup of one) is no longer where fling put it
+			from, err := filepath.Abs(o.From)
+			if err != nil {
+				return fmt.Errorf("couldn't make path absolute: %w", err)
+			}
+			m.remove(from)
+			m.removeDir(from)
+			// a renamed backup (restored, or undone) is no longer a backup
+			m.Backups = slices.DeleteFunc(m.Backups, func(mb manifestBackup) bool { return mb.Backup == from })
+			if strings.HasPrefix(p, from+backupInfix) {
+				m.Backups = append(m.Backups, manifestBackup{Link: from, Backup: p, Run: run})
+			}
+		case opMkdir:
+			m.setDir(manifestDir{Path: p, UnfoldedFrom: removedLinks[p]})
+		case opRemoveDir:
+			m.removeDir(p)
+		case opRemoveFile, opWriteFile:
+			// not links or dirs
+		}
+	}
+	return nil
+}
+
+// forgetMoved forgets links and dirs that were removed or changed without fling, so the
+// manifest only has links that are still where fling put them. Backups are kept while
+// they exist or fling's link is still in their place, so a missing one can be reported.
+func (m *manifest) forgetMoved() {
+	m.Links = slices.DeleteFunc(m.Links, func(e manifestLink) bool {
+		target, err := os.Readlink(e.Link)
+		return err != nil || target != e.Target
+	})
+	m.Dirs = slices.DeleteFunc(m.Dirs, func(e manifestDir) bool {
+		info, err := os.Lstat(e.Path)
+		return err != nil || !info.IsDir()
+	})
+	m.Backups = slices.DeleteFunc(m.Backups, func(mb manifestBackup) bool {
+		_, found := m.find(mb.Link)
+		_, err := os.Lstat(mb.Backup)
+		return !found && err != nil
+	})
+}
+
+// lockManifest holds an exclusive lock on manifest.lock in the state dir until the returned
+// unlock is called, so concurrent runs don't lose each other's manifest updates
+func lockManifest() (func(), error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create state dir: %w", err)
+	}
+	return lockFile(filepath.Join(dir, "manifest.lock"))
+}
+
+// recordInManifest updates the manifest with the ops the run with journal ID run applied
+func recordInManifest(ops []op, srcDirs []string, run string) error {
+	p, err := manifestPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := readManifest(p)
+	if err != nil {
+		return err
+	}
+	err = m.update(ops, srcDirs, run)
+	if err != nil {
+		return err
+	}
+	m.forgetMoved()
+	return writeManifest(p, m)
+}
+
+// manifestLinksIn returns the links in m that are in one of linkDirs and, if srcDirs
+// isn't empty, were linked from one of srcDirs
+func manifestLinksIn(m *manifest, linkDirs []string, srcDirs []string) ([]manifestLink, error) {
+	absLinkDirs := make([]string, len(linkDirs))
+	for i, dir := range linkDirs {
+		var err error
+		absLinkDirs[i], err = filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't make link dir absolute: %w", err)
+		}
+	}
+	absSrcDirs := make([]string, len(srcDirs))
+	for i, dir := range srcDirs {
+		var err error
+		absSrcDirs[i], err = filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't make src dir absolute: %w", err)
+		}
+	}
+	var ret []manifestLink
+	for _, e := range m.Links {
+		if !slices.ContainsFunc(absLinkDirs, func(dir string) bool { return isUnderDir(e.Link, dir) }) {
+			continue
+		}
+		if len(absSrcDirs) > 0 && !slices.Contains(absSrcDirs, e.SrcDir) {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// annotateManifestConflicts adds which src dir fling linked a conflicting link from
+// to fi.pathsErrs, so runs from different src dirs can tell they target the same link path
+func annotateManifestConflicts(fi *fileInfo, m *manifest, srcDirs []string) {
+	for i, e := range fi.pathsErrs {
+		link, err := filepath.Abs(e.link)
+		if err != nil {
+			continue
+		}
+		ml, found := m.find(link)
+		if !found {
+			continue
+		}
+		target, err := os.Readlink(link)
+		if err != nil || target != ml.Target {
+			continue
+		}
+		if ml.SrcDir == "" {
+			fi.pathsErrs[i].err = fmt.Errorf("%w (fling linked it to %s)", e.err, ml.Src)
+			continue
+		}
+		if srcDirOf(e.src, srcDirs) == ml.SrcDir {
+			// a conflict within this run's src dir, which the error already explains
+			continue
+		}
+		fi.pathsErrs[i].err = fmt.Errorf("%w (fling linked it from --src-dir %s)", e.err, ml.SrcDir)
+	}
+}
+
+// readStateManifest reads the manifest in the state dir. A manifest that can't be read
+// only prints a warning and is empty, so only what's safe without it is planned.
+func readStateManifest(purpose string) *manifest {
+	p, err := manifestPath()
+	if err == nil {
+		var m *manifest
+		m, err = readManifest(p)
+		if err == nil {
+			return m
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Warning: couldn't read the manifest, so %s: %v\n", purpose, err)
+	return &manifest{Version: manifestVersion, Links: nil, Dirs: nil, Backups: nil}
+}
+
+// annotateFromManifest is annotateManifestConflicts with the manifest in the state dir.
+// A manifest that can't be read only prints a warning.
+func annotateFromManifest(fi *fileInfo, srcDirs []string) {
+	p, err := manifestPath()
+	if err == nil {
+		var m *manifest
+		m, err = readManifest(p)
+		if err == nil {
+			annotateManifestConflicts(fi, m, srcDirs)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't check the manifest for links from other src dirs: %v\n", err)
+	}
+}
+
+// unlinkFromManifest is unlink --manifest. It deletes the links in the manifest that are
+// in --link-dir (and, if passed, were linked from a --src-dir) and still point where fling
+// put them. It doesn't read the src dirs, so it works after they're moved or deleted.
+func unlinkFromManifest(ctx warg.CmdContext, cf commonFlags, restoreBackups bool, r *reporter) error {
+	p, err := manifestPath()
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+	m, err := readManifest(p)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+	linkDirs := []string{cf.linkDir}
+	if len(cf.srcDirs) > 0 {
+		linkDirs = cf.opts.linkDirs(cf.srcDirs, cf.linkDir)
+	}
+	entries, err := manifestLinksIn(m, linkDirs, cf.srcDirs)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	var links []linkT
+	var moved []linkT
+	var outOfScope []linkT
+	for _, e := range entries {
+		lt := linkT{src: e.Src, link: e.Link}
+		target, err := os.Readlink(e.Link)
+		switch {
+		case cf.opts.scope != nil && !cf.opts.scope.contains(lt, cf.srcDirs, cf.linkDir, cf.opts):
+			outOfScope = append(outOfScope, lt)
+		case err == nil && target == e.Target:
+			links = append(links, lt)
+		default:
+			moved = append(moved, lt)
+		}
+	}
+
+	ltd, err := planDeleteLinks(cf.linkDir, links, cf.opts, m, restoreBackups)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	if r.isJSON() {
+		r.doc.LinksToDelete = newJSONLinksToDelete(ltd)
+	} else {
+		f := bufio.NewWriter(os.Stdout)
+		if len(outOfScope) > 0 {
+			fPrintHeader(f, r.color, "Out of scope (not matched by --only or --target, so left alone):")
+			fPrintLinkTs(f, r.color, outOfScope)
+			fmt.Fprintln(f)
+		}
+		if len(moved) > 0 {
+			fPrintHeader(f, r.color, "Links no longer where fling put them (won't be deleted):")
+			fPrintLinkTs(f, r.color, moved)
+			fmt.Fprintln(f)
+		}
+		if len(links) > 0 {
+			fPrintHeader(f, r.color, "Links to delete (from the manifest):")
+			fPrintLinkTs(f, r.color, links)
+			fmt.Fprintln(f)
+		}
+		fPrintDeleteCleanup(f, r.color, ltd)
+		f.Flush()
+	}
+	if len(links) == 0 {
+		return r.finish(outcomeNothingToDo, nil)
+	}
+
+	ops, err := unlinkOps(ltd)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+
+	keepGoing, err := r.ask("Delete links?", cf.ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecord(ctx.Context, "unlink", cf.srcDirs, cf.linkDir, ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.bbkane.com/gocolor"
+)
+
+// opKind is the kind of filesystem change an op makes
+type opKind string
+
+const (
+	// opCreateLink creates a symlink at path to target. path must not exist
+	opCreateLink opKind = "create_link"
+	// opRemoveLink removes the symlink at path, which must still point to target
+	opRemoveLink opKind = "remove_link"
+	// opMkdir creates a dir at path with mode. path must not exist
+	opMkdir opKind = "mkdir"
+	// opRemoveDir removes the dir at path, which must be empty
+	opRemoveDir opKind = "remove_dir"
+	// opRemoveFile removes the regular file at path
+	opRemoveFile opKind = "remove_file"
+	// opRename renames from to path. path must not exist
+	opRename opKind = "rename"
+	// opReplaceWithLink atomically replaces the regular file at path, which must still be
+	// identical to src, with a symlink to target
+	opReplaceWithLink opKind = "replace_with_link"
+	// opReplaceWithCopy atomically replaces the symlink at path, which must still point
+	// to target, with a copy of src with mode. It undoes replace_with_link
+	opReplaceWithCopy opKind = "replace_with_copy"
+	// opWriteFile atomically writes content with mode to path (a template rendered from src),
+	// replacing the regular file there, if any, and creating missing parent dirs
+	opWriteFile opKind = "write_file"
+)
+
+// op is one filesystem change. link, unlink, and sync turn their plans into ops, and
+// fling plan saves them so fling apply can check and apply them later.
+type op struct {
+	Kind opKind `json:"kind"`
+	Path string `json:"path"`
+	// Target is the symlink target for create_link, remove_link, and replace_with_link
+	Target string `json:"target,omitempty"`
+	// From is the path rename moves to Path
+	From string `json:"from,omitempty"`
+	// Src is the file replace_with_link checks Path is still identical to, the file
+	// replace_with_copy copies, and the template write_file rendered
+	Src string `json:"src,omitempty"`
+	// Hash is the sha256 of what write_file writes (see contentHash). Templates can render
+	// secrets, so what they render isn't saved in plans or the journal.
+	Hash string `json:"hash,omitempty"`
+	// Mode is the permissions mkdir, replace_with_copy, and write_file create Path with. When
+	// remove_dir and replace_with_link are applied, it's set to the permissions of what they
+	// replaced, so they can be undone
+	Mode fs.FileMode `json:"mode,omitempty"`
+	// content is what write_file writes. Ops read from a plan file don't have it until
+	// their templates are rendered again (see renderWriteFiles).
+	content string
+}
+
+func newCreateLinkOp(path string, target string) op {
+	return op{Kind: opCreateLink, Path: path, Target: target, From: "", Src: "", Hash: "", Mode: 0, content: ""}
+}
+
+func newRemoveLinkOp(path string, target string) op {
+	return op{Kind: opRemoveLink, Path: path, Target: target, From: "", Src: "", Hash: "", Mode: 0, content: ""}
+}
+
+func newMkdirOp(path string, mode fs.FileMode) op {
+	return op{Kind: opMkdir, Path: path, Target: "", From: "", Src: "", Hash: "", Mode: mode, content: ""}
+}
+
+func newRemoveDirOp(path string) op {
+	return op{Kind: opRemoveDir, Path: path, Target: "", From: "", Src: "", Hash: "", Mode: 0, content: ""}
+}
+
+func newRemoveFileOp(path string) op {
+	return op{Kind: opRemoveFile, Path: path, Target: "", From: "", Src: "", Hash: "", Mode: 0, content: ""}
+}
+
+func newRenameOp(from string, path string) op {
+	return op{Kind: opRename, Path: path, Target: "", From: from, Src: "", Hash: "", Mode: 0, content: ""}
+}
+
+func newReplaceWithLinkOp(path string, target string, src string) op {
+	return op{Kind: opReplaceWithLink, Path: path, Target: target, From: "", Src: src, Hash: "", Mode: 0, content: ""}
+}
+
+func newReplaceWithCopyOp(path string, target string, src string, mode fs.FileMode) op {
+	return op{Kind: opReplaceWithCopy, Path: path, Target: target, From: "", Src: src, Hash: "", Mode: mode, content: ""}
+}
+
+func newWriteFileOp(path string, content string, mode fs.FileMode, src string) op {
+	return op{Kind: opWriteFile, Path: path, Target: "", From: "", Src: src, Hash: contentHash(content), Mode: mode, content: content}
+}
+
+func (o op) ColorString(color *gocolor.Color) string {
+	switch o.Kind {
+	case opCreateLink, opRemoveLink, opReplaceWithLink:
+		return fmt.Sprintf(
+			"- %s: %s\n  %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.Path,
+			color.Add(color.Bold, "target"),
+			o.Target,
+		)
+	case opMkdir:
+		return fmt.Sprintf(
+			"- %s: %s\n  %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.Path,
+			color.Add(color.Bold, "mode"),
+			o.Mode,
+		)
+	case opReplaceWithCopy:
+		return fmt.Sprintf(
+			"- %s: %s\n  %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.Path,
+			color.Add(color.Bold, "src"),
+			o.Src,
+		)
+	case opWriteFile:
+		return fmt.Sprintf(
+			"- %s: %s\n  %s: %s\n  %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.Path,
+			color.Add(color.Bold, "src"),
+			o.Src,
+			color.Add(color.Bold, "sha256"),
+			o.Hash,
+		)
+	case opRename:
+		return fmt.Sprintf(
+			"- %s: %s\n  %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.From,
+			color.Add(color.Bold, "to"),
+			o.Path,
+		)
+	case opRemoveDir, opRemoveFile:
+		return fmt.Sprintf(
+			"- %s: %s",
+			color.Add(color.Bold, string(o.Kind)),
+			o.Path,
+		)
+	default:
+		return fmt.Sprintf("- unknown op kind %q: %s", o.Kind, o.Path)
+	}
+}
+
+func fPrintOps(f *bufio.Writer, color *gocolor.Color, ops []op) {
+	for _, o := range ops {
+		fmt.Fprintf(f, "%s\n", o.ColorString(color))
+	}
+}
+
+// linkOps returns the ops that make the changes link planned in fi
+func linkOps(fi *fileInfo, linkStyle string) ([]op, error) {
+	var ops []op
+	// render templates first, so links to them never point to missing or stale files
+	for _, e := range fi.templatesToRender {
+		ops = append(ops, newWriteFileOp(e.generated, e.content, e.mode, e.src))
+	}
+	createLink := func(e linkT) error {
+		target, err := symlinkTarget(e.src, e.link, linkStyle)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, newCreateLinkOp(e.link, target))
+		return nil
+	}
+
+	// buildFileInfo plans links for the children of unfolded dirs
+	for _, e := range fi.dirsToUnfold {
+		srcInfo, err := os.Stat(e.src)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't stat dir to unfold: %w", err)
+		}
+		target, err := os.Readlink(e.link)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dir link to unfold: %w", err)
+		}
+		ops = append(ops, newRemoveLinkOp(e.link, target), newMkdirOp(e.link, srcInfo.Mode().Perm()))
+	}
+	// sorted by link, so parents are created before children
+	for _, e := range fi.dirsToCreate {
+		srcInfo, err := os.Stat(e.src)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, newMkdirOp(e.link, srcInfo.Mode().Perm()))
+	}
+	for _, e := range fi.identicalFiles {
+		target, err := symlinkTarget(e.src, e.link, linkStyle)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, newReplaceWithLinkOp(e.link, target, e.src))
+	}
+	for _, e := range fi.pathsToAdopt {
+		// os.Rename replaces files, but not with directories, so always remove src first
+		ops = append(ops, newRemoveFileOp(e.src), newRenameOp(e.link, e.src))
+		err := createLink(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, e := range fi.pathsToBackup {
+		backup, err := backupPath(e.link, now)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, newRenameOp(e.link, backup))
+		err = createLink(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range fi.dirLinksToCreate {
+		err := createLink(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range fi.fileLinksToCreate {
+		err := createLink(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// unlinkOps returns the ops that make the changes planned in ltd
+func unlinkOps(ltd *linksToDelete) ([]op, error) {
+	var ops []op
+	deleting := make(map[string]bool)
+	for _, e := range ltd.links {
+		target, err := os.Readlink(e.link)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read link to delete: %w", err)
+		}
+		deleting[e.link] = true
+		ops = append(ops, newRemoveLinkOp(e.link, target))
+	}
+	// deepest dirs first
+	for _, e := range slices.Backward(ltd.emptyDirsToDelete) {
+		ops = append(ops, newRemoveDirOp(e.link))
+	}
+	// replace the links left in the dir with one link to the dir they point into.
+	// The new link is relative if the links it replaces were.
+	for _, e := range ltd.dirsToRefold {
+		entries, err := os.ReadDir(e.link)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dir to refold: %w", err)
+		}
+		linkStyle := "absolute"
+		for _, entry := range entries {
+			p := filepath.Join(e.link, entry.Name())
+			if deleting[p] {
+				continue
+			}
+			target, err := os.Readlink(p)
+			if err != nil {
+				return nil, fmt.Errorf("dir to refold contains a non-link: %w", err)
+			}
+			if !filepath.IsAbs(target) {
+				linkStyle = "relative"
+			}
+			ops = append(ops, newRemoveLinkOp(p, target))
+		}
+		target, err := symlinkTarget(e.src, e.link, linkStyle)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, newRemoveDirOp(e.link), newCreateLinkOp(e.link, target))
+	}
+	for _, e := range ltd.backupsToRestore {
+		ops = append(ops, newRenameOp(e.backup, e.link))
+	}
+	return ops, nil
+}
+
+// simEntryKind is what checkOps thinks is at a path
+type simEntryKind string
+
+const (
+	simAbsent  simEntryKind = "absent"
+	simLink    simEntryKind = "link"
+	simDir     simEntryKind = "dir"
+	simFile    simEntryKind = "file"
+	simUnknown simEntryKind = "unknown"
+)
+
+type simEntry struct {
+	kind simEntryKind
+	// target is set for links
+	target string
+}
+
+// opSim tracks the paths changed by the ops checkOps has checked so far, so later
+// ops are checked against the filesystem as it will be when they're applied.
+type opSim struct {
+	entries map[string]simEntry
+}
+
+// changedAncestor reports whether an ancestor of p was changed by an earlier op. That
+// means p is absent (unless an earlier op created it), no matter what's there now.
+func (s *opSim) changedAncestor(p string) bool {
+	for dir := filepath.Dir(p); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, exists := s.entries[dir]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *opSim) lookup(p string) (simEntry, error) {
+	if e, exists := s.entries[p]; exists {
+		return e, nil
+	}
+	if s.changedAncestor(p) {
+		return simEntry{kind: simAbsent, target: ""}, nil
+	}
+	info, err := os.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return simEntry{kind: simAbsent, target: ""}, nil
+	}
+	if err != nil {
+		return simEntry{kind: simUnknown, target: ""}, err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return simEntry{kind: simUnknown, target: ""}, err
+		}
+		return simEntry{kind: simLink, target: target}, nil
+	case info.IsDir():
+		return simEntry{kind: simDir, target: ""}, nil
+	case info.Mode().IsRegular():
+		return simEntry{kind: simFile, target: ""}, nil
+	default:
+		return simEntry{kind: simUnknown, target: ""}, nil
+	}
+}
+
+// isDir reports whether p will be a dir (following symlinks, unlike lookup)
+func (s *opSim) isDir(p string) bool {
+	if e, exists := s.entries[p]; exists {
+		return e.kind == simDir
+	}
+	if s.changedAncestor(p) {
+		return false
+	}
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// isEmptyDir reports whether the dir p will be empty
+func (s *opSim) isEmptyDir(p string) (bool, error) {
+	for path, e := range s.entries {
+		if filepath.Dir(path) == p && e.kind != simAbsent {
+			return false, nil
+		}
+	}
+	if _, exists := s.entries[p]; exists || s.changedAncestor(p) {
+		return true, nil
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		child, err := s.lookup(filepath.Join(p, e.Name()))
+		if err != nil {
+			return false, err
+		}
+		if child.kind != simAbsent {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// check returns an error if o can't be applied after the ops already checked,
+// then records o's changes.
+func (s *opSim) check(o op) error {
+	cur, err := s.lookup(o.Path)
+	if err != nil {
+		return err
+	}
+	absent := simEntry{kind: simAbsent, target: ""}
+
+	switch o.Kind {
+	case opCreateLink:
+		if cur.kind != simAbsent {
+			return errors.New("path already exists")
+		}
+		if !s.isDir(filepath.Dir(o.Path)) {
+			return errors.New("parent dir doesn't exist")
+		}
+		s.entries[o.Path] = simEntry{kind: simLink, target: o.Target}
+	case opRemoveLink:
+		if cur.kind != simLink || cur.target != o.Target {
+			return fmt.Errorf("path is no longer a link to %s", o.Target)
+		}
+		s.entries[o.Path] = absent
+	case opMkdir:
+		if cur.kind != simAbsent {
+			return errors.New("path already exists")
+		}
+		if !s.isDir(filepath.Dir(o.Path)) {
+			return errors.New("parent dir doesn't exist")
+		}
+		s.entries[o.Path] = simEntry{kind: simDir, target: ""}
+	case opRemoveDir:
+		if cur.kind != simDir {
+			return errors.New("path is not a dir")
+		}
+		empty, err := s.isEmptyDir(o.Path)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return errors.New("dir is not empty")
+		}
+		s.entries[o.Path] = absent
+	case opRemoveFile:
+		if cur.kind != simFile {
+			return errors.New("path is not a regular file")
+		}
+		s.entries[o.Path] = absent
+	case opRename:
+		from, err := s.lookup(o.From)
+		if err != nil {
+			return err
+		}
+		if from.kind == simAbsent {
+			return fmt.Errorf("path to rename doesn't exist: %s", o.From)
+		}
+		if cur.kind != simAbsent {
+			return errors.New("path already exists")
+		}
+		if !s.isDir(filepath.Dir(o.Path)) {
+			return errors.New("parent dir doesn't exist")
+		}
+		// os.Rename can't move paths between filesystems (EXDEV), like from a mounted home dir
+		same, err := sameFilesystem(closestExisting(o.From), closestExisting(filepath.Dir(o.Path)))
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("%s is on a different filesystem, so it can't be moved here. Move it yourself (like with mv), then link it", o.From)
+		}
+		s.entries[o.Path] = from
+		s.entries[o.From] = absent
+	case opReplaceWithLink:
+		if cur.kind != simFile {
+			return errors.New("path is not a regular file")
+		}
+		if _, changed := s.entries[o.Path]; !changed {
+			identical, err := filesIdentical(o.Src, o.Path)
+			if err != nil {
+				return err
+			}
+			if !identical {
+				return fmt.Errorf("file is no longer identical to %s", o.Src)
+			}
+		}
+		s.entries[o.Path] = simEntry{kind: simLink, target: o.Target}
+	case opReplaceWithCopy:
+		if cur.kind != simLink || cur.target != o.Target {
+			return fmt.Errorf("path is no longer a link to %s", o.Target)
+		}
+		s.entries[o.Path] = simEntry{kind: simFile, target: ""}
+	case opWriteFile:
+		if cur.kind != simAbsent && cur.kind != simFile {
+			return errors.New("path is not a regular file")
+		}
+		if contentHash(o.content) != o.Hash {
+			return fmt.Errorf("template %s renders differently than when planned (it, the template data, or this machine changed). Plan again", o.Src)
+		}
+		s.entries[o.Path] = simEntry{kind: simFile, target: ""}
+	default:
+		return fmt.Errorf("unknown op kind: %q", o.Kind)
+	}
+	return nil
+}
+
+// closestExisting returns p, or its closest parent that exists if it doesn't, since ops
+// checked before it may create it
+func closestExisting(p string) string {
+	for {
+		_, err := os.Lstat(p)
+		parent := filepath.Dir(p)
+		if err == nil || parent == p {
+			return p
+		}
+		p = parent
+	}
+}
+
+// checkOps checks that every op can still be applied, in order, to the filesystem as it is now
+func checkOps(ops []op) error {
+	sim := opSim{entries: make(map[string]simEntry)}
+	var errs []error
+	for _, o := range ops {
+		err := sim.check(o)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", o.Kind, o.Path, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("some operations can't be applied (did the filesystem change since planning?):\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// replaceWithCopy atomically replaces the link at p with a copy of src with mode
+func replaceWithCopy(src string, p string, mode fs.FileMode) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".fling-tmp")
+	err = os.WriteFile(tmp, content, mode)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, p)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeFile atomically writes content with mode to p, creating its missing parent dirs
+func writeFile(p string, content string, mode fs.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".fling-tmp")
+	err = os.WriteFile(tmp, []byte(content), mode)
+	if err == nil {
+		// WriteFile's mode is masked by the umask
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// applyOp makes the change described by o. Use opTx.apply to be able to undo it.
+func applyOp(o op) error {
+	var err error
+	switch o.Kind {
+	case opCreateLink:
+		err = os.Symlink(o.Target, o.Path)
+	case opRemoveLink, opRemoveDir, opRemoveFile:
+		err = os.Remove(o.Path)
+	case opMkdir:
+		err = os.Mkdir(o.Path, o.Mode)
+	case opRename:
+		err = os.Rename(o.From, o.Path)
+	case opReplaceWithLink:
+		err = replaceWithLink(o.Target, o.Path)
+	case opReplaceWithCopy:
+		err = replaceWithCopy(o.Src, o.Path, o.Mode)
+	case opWriteFile:
+		err = writeFile(o.Path, o.content, o.Mode)
+	default:
+		err = fmt.Errorf("unknown op kind: %q", o.Kind)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't %s %s: %w", o.Kind, o.Path, err)
+	}
+	return nil
+}
+
+// inverseOp returns the op that undoes o. remove_dir and replace_with_link need the
+// Mode opTx.apply fills in. Removed and overwritten files can't be brought back.
+func inverseOp(o op) (op, error) {
+	switch o.Kind {
+	case opCreateLink:
+		return newRemoveLinkOp(o.Path, o.Target), nil
+	case opRemoveLink:
+		return newCreateLinkOp(o.Path, o.Target), nil
+	case opMkdir:
+		inverse := newRemoveDirOp(o.Path)
+		inverse.Mode = o.Mode
+		return inverse, nil
+	case opRemoveDir:
+		return newMkdirOp(o.Path, o.Mode), nil
+	case opRename:
+		return newRenameOp(o.Path, o.From), nil
+	case opReplaceWithLink:
+		// the file was identical to src, so a copy of src brings it back
+		return newReplaceWithCopyOp(o.Path, o.Target, o.Src, o.Mode), nil
+	case opReplaceWithCopy:
+		inverse := newReplaceWithLinkOp(o.Path, o.Target, o.Src)
+		inverse.Mode = o.Mode
+		return inverse, nil
+	case opRemoveFile:
+		return o, fmt.Errorf("can't undo removing a file: %s", o.Path)
+	case opWriteFile:
+		return o, fmt.Errorf("can't undo writing a file: %s", o.Path)
+	default:
+		return o, fmt.Errorf("unknown op kind: %q", o.Kind)
+	}
+}
+
+// appliedOp is an op opTx applied, along with what's needed to undo it
+type appliedOp struct {
+	op op
+	// trash is where remove_file (or write_file, if it replaced a file) moved the file to
+	// until the transaction is committed
+	trash string
+}
+
+// opTx applies ops and remembers them, so they can all be undone if a later op fails
+type opTx struct {
+	applied []appliedOp
+}
+
+// trashPath is where remove_file moves p until the transaction is committed
+func trashPath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".fling-rm")
+}
+
+// moveToTrash moves p to trashPath(p)
+func moveToTrash(p string) (string, error) {
+	trash := trashPath(p)
+	_, err := os.Lstat(trash)
+	if err == nil {
+		return "", fmt.Errorf("path to move removed file to already exists: %s", trash)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	err = os.Rename(p, trash)
+	if err != nil {
+		return "", err
+	}
+	return trash, nil
+}
+
+// apply makes the change described by o
+func (tx *opTx) apply(o op) error {
+	switch o.Kind {
+	case opRemoveDir, opReplaceWithLink:
+		// remember the mode so it can be restored
+		info, err := os.Lstat(o.Path)
+		if err != nil {
+			return fmt.Errorf("couldn't %s %s: %w", o.Kind, o.Path, err)
+		}
+		o.Mode = info.Mode().Perm()
+	case opRemoveFile:
+		// keep the file until the transaction is committed
+		trash, err := moveToTrash(o.Path)
+		if err != nil {
+			return fmt.Errorf("couldn't %s %s: %w", o.Kind, o.Path, err)
+		}
+		tx.applied = append(tx.applied, appliedOp{op: o, trash: trash})
+		return nil
+	case opWriteFile:
+		// keep the file being replaced until the transaction is committed
+		trash := ""
+		_, err := os.Lstat(o.Path)
+		if err == nil {
+			trash, err = moveToTrash(o.Path)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("couldn't %s %s: %w", o.Kind, o.Path, err)
+		}
+		err = applyOp(o)
+		if err != nil {
+			if trash != "" {
+				_ = os.Rename(trash, o.Path)
+			}
+			return err
+		}
+		tx.applied = append(tx.applied, appliedOp{op: o, trash: trash})
+		return nil
+	default:
+		// no extra bookkeeping needed
+	}
+	err := applyOp(o)
+	if err != nil {
+		return err
+	}
+	tx.applied = append(tx.applied, appliedOp{op: o, trash: ""})
+	return nil
+}
+
+// undo reverses ao
+func undo(ao appliedOp) error {
+	if ao.op.Kind == opWriteFile {
+		err := os.Remove(ao.op.Path)
+		if err != nil || ao.trash == "" {
+			return err
+		}
+	}
+	if ao.trash != "" {
+		return os.Rename(ao.trash, ao.op.Path)
+	}
+	inverse, err := inverseOp(ao.op)
+	if err != nil {
+		return err
+	}
+	return applyOp(inverse)
+}
+
+// rollback undoes the applied ops, most recent first. It keeps going after errors,
+// so as much as possible is undone. It returns the ops that were undone.
+func (tx *opTx) rollback() ([]op, error) {
+	var undone []op
+	var errs []error
+	for _, ao := range slices.Backward(tx.applied) {
+		err := undo(ao)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("couldn't undo %s %s: %w", ao.op.Kind, ao.op.Path, err))
+			continue
+		}
+		undone = append(undone, ao.op)
+	}
+	tx.applied = nil
+	return undone, errors.Join(errs...)
+}
+
+// commit deletes the files remove_file and write_file moved out of the way
+func (tx *opTx) commit() error {
+	var errs []error
+	for _, ao := range tx.applied {
+		if ao.trash != "" {
+			err := os.Remove(ao.trash)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("couldn't delete removed file: %w", err))
+			}
+		}
+	}
+	tx.applied = nil
+	return errors.Join(errs...)
+}
+
+// commitOrWarn commits tx. The changes were already made, so not being able to delete
+// the files they replaced only prints a warning.
+func (tx *opTx) commitOrWarn() {
+	err := tx.commit()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: the changes were made, but some files they replaced couldn't be deleted: %v\n", err)
+	}
+}
+
+// rollbackError is returned by applyOps after it rolled back the ops it applied
+type rollbackError struct {
+	// err is why the ops were rolled back
+	err error
+	// rolledBack are the ops that were undone, most recent first
+	rolledBack []op
+	// rollbackErr is set if some ops couldn't be undone
+	rollbackErr error
+}
+
+func (e *rollbackError) Error() string {
+	msg := fmt.Sprintf("%v\nrolled back %d operation(s)", e.err, len(e.rolledBack))
+	if e.rollbackErr != nil {
+		msg += fmt.Sprintf(", but some couldn't be rolled back:\n%v", e.rollbackErr)
+	}
+	return msg
+}
+
+func (e *rollbackError) Unwrap() error {
+	return e.err
+}
+
+// applyOps checks every op can be applied (see checkOps) before applying any of them.
+// If an op fails or fling is interrupted (Ctrl-C) partway through, the ops already applied
+// are undone in reverse order and a *rollbackError is returned. Otherwise, it returns the
+// applied ops, with the Mode of remove_dir and replace_with_link ops filled in, and
+// commits (see commitOrWarn).
+func applyOps(ctx context.Context, ops []op) ([]op, error) {
+	tx, applied, err := applyOpsUncommitted(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+	tx.commitOrWarn()
+	return applied, nil
+}
+
+// applyOpsUncommitted is applyOps without committing the returned transaction, so the
+// applied ops can be recorded before the files they replaced are deleted
+func applyOpsUncommitted(ctx context.Context, ops []op) (*opTx, []op, error) {
+	err := checkOps(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	tx := opTx{applied: nil}
+	for _, o := range ops {
+		err := ctx.Err()
+		if err != nil {
+			err = fmt.Errorf("interrupted: %w", err)
+		} else {
+			err = tx.apply(o)
+		}
+		if err != nil {
+			rolledBack, rollbackErr := tx.rollback()
+			return nil, nil, &rollbackError{err: err, rolledBack: rolledBack, rollbackErr: rollbackErr}
+		}
+	}
+	applied := make([]op, len(tx.applied))
+	for i, ao := range tx.applied {
+		applied[i] = ao.op
+	}
+	return &tx, applied, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.bbkane.com/gocolor"
+)
+
+// --format choices
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// jsonVersion is the version of the document --format json prints. Adding fields
+// doesn't change it, but renaming or removing fields (or changing their meaning) does.
+const jsonVersion = 1
+
+// outcome is how a command finished
+type outcome string
+
+const (
+	// outcomeErrors means the plan has errors, so nothing was changed
+	outcomeErrors outcome = "errors"
+	// outcomeNothingToDo means the plan is empty
+	outcomeNothingToDo outcome = "nothing_to_do"
+	// outcomeDryRun means the plan was printed because of --ask dry-run
+	outcomeDryRun outcome = "dry_run"
+	// outcomeAborted means the prompt wasn't answered with 'yes'
+	outcomeAborted outcome = "aborted"
+	// outcomeFailed means making changes failed partway through and rolling them back failed too
+	outcomeFailed outcome = "failed"
+	// outcomeRolledBack means making changes failed (or was interrupted) partway through, and
+	// the changes already made were undone
+	outcomeRolledBack outcome = "rolled_back"
+	// outcomeDone means all changes were made
+	outcomeDone outcome = "done"
+)
+
+type jsonLinkT struct {
+	Src  string `json:"src"`
+	Link string `json:"link"`
+}
+
+type jsonChosenAlternate struct {
+	Src    string `json:"src"`
+	Link   string `json:"link"`
+	Reason string `json:"reason"`
+}
+
+type jsonTemplateToRender struct {
+	Src       string `json:"src"`
+	Generated string `json:"generated"`
+}
+
+type jsonIgnoredPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type jsonBackupToRestore struct {
+	Backup string `json:"backup"`
+	Link   string `json:"link"`
+}
+
+type jsonPathErr struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type jsonPathsErr struct {
+	Src   string `json:"src"`
+	Link  string `json:"link"`
+	Error string `json:"error"`
+}
+
+// jsonFileInfo has a field for every fileInfo field. Empty categories are [], not null
+type jsonFileInfo struct {
+	ChosenAlternates  []jsonChosenAlternate `json:"chosenAlternates"`
+	DirLinksToCreate  []jsonLinkT           `json:"dirLinksToCreate"`
+	DirsToCreate      []jsonLinkT           `json:"dirsToCreate"`
+	DirsToUnfold      []jsonLinkT           `json:"dirsToUnfold"`
+	ExistingDirLinks  []jsonLinkT           `json:"existingDirLinks"`
+	ExistingDirs      []jsonLinkT           `json:"existingDirs"`
+	ExistingFileLinks []jsonLinkT           `json:"existingFileLinks"`
+	FileLinksToCreate []jsonLinkT           `json:"fileLinksToCreate"`
+	IdenticalFiles    []jsonLinkT           `json:"identicalFiles"`
+	IgnoredPaths      []string              `json:"ignoredPaths"`
+	// IgnoredPathReasons has why each of IgnoredPaths is ignored
+	IgnoredPathReasons []jsonIgnoredPath `json:"ignoredPathReasons"`
+	OrphanedLinks      []jsonLinkT       `json:"orphanedLinks"`
+	// OutOfScope are left alone because they don't match --only or --target
+	OutOfScope        []jsonLinkT            `json:"outOfScope"`
+	PathErrs          []jsonPathErr          `json:"pathErrs"`
+	PathsErrs         []jsonPathsErr         `json:"pathsErrs"`
+	PathsToAdopt      []jsonLinkT            `json:"pathsToAdopt"`
+	PathsToBackup     []jsonLinkT            `json:"pathsToBackup"`
+	TemplatesToRender []jsonTemplateToRender `json:"templatesToRender"`
+}
+
+// jsonLinksToDelete is the linksToDelete unlink plans
+type jsonLinksToDelete struct {
+	Links             []jsonLinkT           `json:"links"`
+	EmptyDirsToDelete []jsonLinkT           `json:"emptyDirsToDelete"`
+	DirsToRefold      []jsonLinkT           `json:"dirsToRefold"`
+	BackupsToRestore  []jsonBackupToRestore `json:"backupsToRestore"`
+}
+
+type jsonDoc struct {
+	Version  int           `json:"version"`
+	Command  string        `json:"command"`
+	FileInfo *jsonFileInfo `json:"fileInfo"`
+	// LinksToDelete is only set by unlink
+	LinksToDelete *jsonLinksToDelete `json:"linksToDelete,omitempty"`
+	Outcome       outcome            `json:"outcome"`
+	// RolledBack are the ops undone after a failure, most recent first
+	RolledBack []op `json:"rolledBack"`
+	// Error is "" unless the command returned an error
+	Error string `json:"error"`
+}
+
+func newJSONLinkTs(lTs []linkT) []jsonLinkT {
+	ret := make([]jsonLinkT, len(lTs))
+	for i, e := range lTs {
+		ret[i] = jsonLinkT{Src: e.src, Link: e.link}
+	}
+	return ret
+}
+
+func newJSONFileInfo(fi *fileInfo) *jsonFileInfo {
+	chosenAlternates := make([]jsonChosenAlternate, len(fi.chosenAlternates))
+	for i, e := range fi.chosenAlternates {
+		chosenAlternates[i] = jsonChosenAlternate{Src: e.src, Link: e.link, Reason: e.reason}
+	}
+	ignoredPaths := make([]string, len(fi.ignoredPaths))
+	ignoredPathReasons := make([]jsonIgnoredPath, len(fi.ignoredPaths))
+	for i, e := range fi.ignoredPaths {
+		ignoredPaths[i] = e.path
+		ignoredPathReasons[i] = jsonIgnoredPath{Path: e.path, Reason: e.reason}
+	}
+	pathErrs := make([]jsonPathErr, len(fi.pathErrs))
+	for i, e := range fi.pathErrs {
+		pathErrs[i] = jsonPathErr{Path: e.path, Error: e.err.Error()}
+	}
+	pathsErrs := make([]jsonPathsErr, len(fi.pathsErrs))
+	for i, e := range fi.pathsErrs {
+		pathsErrs[i] = jsonPathsErr{Src: e.src, Link: e.link, Error: e.err.Error()}
+	}
+	templatesToRender := make([]jsonTemplateToRender, len(fi.templatesToRender))
+	for i, e := range fi.templatesToRender {
+		templatesToRender[i] = jsonTemplateToRender{Src: e.src, Generated: e.generated}
+	}
+	return &jsonFileInfo{
+		ChosenAlternates:   chosenAlternates,
+		DirLinksToCreate:   newJSONLinkTs(fi.dirLinksToCreate),
+		DirsToCreate:       newJSONLinkTs(fi.dirsToCreate),
+		DirsToUnfold:       newJSONLinkTs(fi.dirsToUnfold),
+		ExistingDirLinks:   newJSONLinkTs(fi.existingDirLinks),
+		ExistingDirs:       newJSONLinkTs(fi.existingDirs),
+		ExistingFileLinks:  newJSONLinkTs(fi.existingFileLinks),
+		FileLinksToCreate:  newJSONLinkTs(fi.fileLinksToCreate),
+		IdenticalFiles:     newJSONLinkTs(fi.identicalFiles),
+		IgnoredPaths:       ignoredPaths,
+		IgnoredPathReasons: ignoredPathReasons,
+		OrphanedLinks:      newJSONLinkTs(fi.orphanedLinks),
+		OutOfScope:         newJSONLinkTs(fi.outOfScope),
+		PathErrs:           pathErrs,
+		PathsErrs:          pathsErrs,
+		PathsToAdopt:       newJSONLinkTs(fi.pathsToAdopt),
+		PathsToBackup:      newJSONLinkTs(fi.pathsToBackup),
+		TemplatesToRender:  templatesToRender,
+	}
+}
+
+func newJSONLinksToDelete(ltd *linksToDelete) *jsonLinksToDelete {
+	backupsToRestore := make([]jsonBackupToRestore, len(ltd.backupsToRestore))
+	for i, e := range ltd.backupsToRestore {
+		backupsToRestore[i] = jsonBackupToRestore{Backup: e.backup, Link: e.link}
+	}
+	return &jsonLinksToDelete{
+		Links:             newJSONLinkTs(ltd.links),
+		EmptyDirsToDelete: newJSONLinkTs(ltd.emptyDirsToDelete),
+		DirsToRefold:      newJSONLinkTs(ltd.dirsToRefold),
+		BackupsToRestore:  backupsToRestore,
+	}
+}
+
+// reporter prints how a command finished, either as colored text or (with --format json)
+// as one JSON document on stdout once the outcome is known. Commands print their plan
+// as text themselves when the format is text, and fill in doc when it's json.
+type reporter struct {
+	format string
+	color  *gocolor.Color
+	doc    jsonDoc
+	// stdout is os.Stdout except in tests
+	stdout io.Writer
+}
+
+func newReporter(format string, color *gocolor.Color, command string) *reporter {
+	return &reporter{
+		format: format,
+		color:  color,
+		doc: jsonDoc{
+			Version:       jsonVersion,
+			Command:       command,
+			FileInfo:      nil,
+			LinksToDelete: nil,
+			Outcome:       "",
+			RolledBack:    []op{},
+			Error:         "",
+		},
+		stdout: os.Stdout,
+	}
+}
+
+// isJSON reports whether the plan should go in r.doc instead of being printed
+func (r *reporter) isJSON() bool {
+	return r.format == formatJSON
+}
+
+// ask prints question and then calls askPrompt. With --format json, both
+// go to stderr so stdout only has the JSON document.
+func (r *reporter) ask(question string, ask string) (bool, error) {
+	w := r.stdout
+	if r.isJSON() {
+		w = os.Stderr
+	}
+	fmt.Fprint(
+		w,
+		r.color.Add(
+			r.color.Bold,
+			question+"\n",
+		),
+	)
+	return askPrompt(ask, w)
+}
+
+// finish prints the outcome and returns err so commands can return r.finish(...).
+// outcomeFailed becomes outcomeRolledBack if every change was rolled back (see applyOps).
+func (r *reporter) finish(o outcome, err error) error {
+	var rbErr *rollbackError
+	if errors.As(err, &rbErr) {
+		if rbErr.rollbackErr == nil {
+			o = outcomeRolledBack
+		}
+		if rbErr.rolledBack != nil {
+			r.doc.RolledBack = rbErr.rolledBack
+		}
+	}
+
+	if r.isJSON() {
+		r.doc.Outcome = o
+		if err != nil {
+			r.doc.Error = err.Error()
+		}
+		enc := json.NewEncoder(r.stdout)
+		enc.SetIndent("", "  ")
+		encErr := enc.Encode(r.doc)
+		if encErr != nil {
+			return fmt.Errorf("couldn't print JSON: %w", encErr)
+		}
+		return err
+	}
+
+	if len(r.doc.RolledBack) > 0 {
+		f := bufio.NewWriter(r.stdout)
+		fPrintErrorHeader(f, r.color, "Rolled back (most recent first):")
+		fPrintOps(f, r.color, r.doc.RolledBack)
+		fmt.Fprintln(f)
+		f.Flush()
+	}
+
+	msg := ""
+	switch o {
+	case outcomeNothingToDo:
+		msg = "Nothing to do!\n"
+	case outcomeDryRun:
+		msg = "Dry run - no changes made\n"
+	case outcomeDone:
+		msg = "Done!\n"
+	case outcomeErrors, outcomeAborted, outcomeFailed, outcomeRolledBack:
+		// err says what happened
+	}
+	if msg != "" {
+		fmt.Fprint(
+			r.stdout,
+			r.color.Add(
+				r.color.Bold+r.color.FgGreenBright,
+				msg,
+			),
+		)
+	}
+	return err
+}
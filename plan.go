@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+	"go.bbkane.com/warg/path"
+)
+
+// planVersion is the version of the plan files fling plan writes. fling apply
+// refuses plans with other versions.
+const planVersion = 1
+
+// planFile is what fling plan saves for fling apply
+type planFile struct {
+	Version int `json:"version"`
+	// Command is the command that was planned (link or unlink)
+	Command string   `json:"command"`
+	SrcDirs []string `json:"srcDirs"`
+	LinkDir string   `json:"linkDir"`
+	Ops     []op     `json:"ops"`
+}
+
+func writePlanFile(p string, command string, srcDirs []string, linkDir string, ops []op) error {
+	pf := planFile{
+		Version: planVersion,
+		Command: command,
+		SrcDirs: srcDirs,
+		LinkDir: linkDir,
+		Ops:     ops,
+	}
+	if pf.Ops == nil {
+		pf.Ops = []op{}
+	}
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode plan: %w", err)
+	}
+	err = os.WriteFile(p, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't write plan: %w", err)
+	}
+	return nil
+}
+
+func readPlanFile(p string) (*planFile, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read plan: %w", err)
+	}
+	var pf planFile
+	err = json.Unmarshal(data, &pf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode plan: %s: %w", p, err)
+	}
+	if pf.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d (this fling supports version %d): %s", pf.Version, planVersion, p)
+	}
+	return &pf, nil
+}
+
+// savePlan prints ops and writes them to the plan file at p
+func savePlan(color *gocolor.Color, p string, command string, cf commonFlags, ops []op) error {
+	{
+		f := bufio.NewWriter(os.Stdout)
+		if len(ops) > 0 {
+			fPrintHeader(f, color, "Operations:")
+			fPrintOps(f, color, ops)
+			fmt.Fprintln(f)
+		}
+		f.Flush()
+	}
+
+	err := writePlanFile(p, command, cf.srcDirs, cf.linkDir, ops)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("Plan saved to %s. Apply it with 'fling apply --plan-file %s'\n", p, p)
+	if len(ops) == 0 {
+		msg = fmt.Sprintf("Nothing to do! Empty plan saved to %s\n", p)
+	}
+	fmt.Print(
+		color.Add(
+			color.Bold+color.FgGreenBright,
+			msg,
+		),
+	)
+	return nil
+}
+
+func planLink(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+	linkStyle := ctx.Flags["--link-style"].(string)
+	output := ctx.Flags["--output"].(path.Path).MustExpand()
+	cf.opts.onConflict = ctx.Flags["--on-conflict"].(string)
+	cf.opts.unfold = true
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	{
+		f := bufio.NewWriter(os.Stdout)
+		fPrintLinkPlan(f, &color, fi)
+		fPrintOrphanedLinks(f, &color, fi)
+		fPrintPathErrs(f, &color, fi)
+		f.Flush()
+	}
+
+	if len(fi.pathsErrs) > 0 {
+		return errors.New("resolve errors above before planning links")
+	}
+
+	ops, err := linkOps(fi, linkStyle)
+	if err != nil {
+		return err
+	}
+	return savePlan(&color, output, "link", cf, ops)
+}
+
+func planUnlink(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+	restoreBackups := ctx.Flags["--restore-backups"].(bool)
+	output := ctx.Flags["--output"].(path.Path).MustExpand()
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	m := readStateManifest("dirs fling created won't be cleaned up or backups restored")
+	ltd, err := planDeleteLinks(cf.linkDir, slices.Concat(fi.existingDirLinks, fi.existingFileLinks, fi.orphanedLinks), cf.opts, m, restoreBackups)
+	if err != nil {
+		return err
+	}
+
+	{
+		f := bufio.NewWriter(os.Stdout)
+		fPrintUnlinkPlan(f, &color, fi, ltd)
+		fPrintPathErrs(f, &color, fi)
+		f.Flush()
+	}
+
+	if len(fi.pathsErrs) > 0 {
+		return errors.New("resolve errors above before planning to delete links")
+	}
+
+	ops, err := unlinkOps(ltd)
+	if err != nil {
+		return err
+	}
+	return savePlan(&color, output, "unlink", cf, ops)
+}
+
+func apply(ctx warg.CmdContext) error {
+	ask := ctx.Flags["--ask"].(string)
+	planPath := ctx.Flags["--plan-file"].(path.Path).MustExpand()
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	pf, err := readPlanFile(planPath)
+	if err != nil {
+		return err
+	}
+
+	r := newReporter(formatText, &color, "apply")
+
+	{
+		f := bufio.NewWriter(os.Stdout)
+		if len(pf.Ops) > 0 {
+			fPrintHeader(f, &color, fmt.Sprintf("Operations (planned by 'fling plan %s'):", pf.Command))
+			fPrintOps(f, &color, pf.Ops)
+			fmt.Fprintln(f)
+		}
+		f.Flush()
+	}
+
+	if len(pf.Ops) == 0 {
+		return r.finish(outcomeNothingToDo, nil)
+	}
+
+	// plans only have the hash of what templates render to
+	if slices.ContainsFunc(pf.Ops, func(o op) bool { return o.Kind == opWriteFile }) {
+		t, err := getTemplateOpts(ctx, currentMachine())
+		if err != nil {
+			return r.finish(outcomeErrors, err)
+		}
+		err = renderWriteFiles(pf.Ops, t)
+		if err != nil {
+			return r.finish(outcomeErrors, err)
+		}
+	}
+
+	// check before asking so there's no point agreeing to a plan that can't be applied
+	err = checkOps(pf.Ops)
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	keepGoing, err := r.ask("Apply plan?", ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecord(ctx.Context, "apply", pf.SrcDirs, pf.LinkDir, pf.Ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
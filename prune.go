@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+)
+
+func prune(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+
+	m := readStateManifest("dirs fling created won't be cleaned up")
+	ltd, err := planDeleteLinks(cf.linkDir, fi.orphanedLinks, cf.opts, m, false)
+	if err != nil {
+		return err
+	}
+
+	r := newReporter(formatText, &color, "prune")
+
+	// Print orphaned links and cleanup. Other errors don't matter when only deleting orphaned links
+	{
+		f := bufio.NewWriter(os.Stdout)
+		if len(fi.orphanedLinks) > 0 {
+			fPrintHeader(f, &color, "Orphaned links to delete (src doesn't exist):")
+			fPrintLinkTs(f, &color, fi.orphanedLinks)
+			fmt.Fprintln(f)
+		}
+		fPrintDeleteCleanup(f, &color, ltd)
+		f.Flush()
+	}
+
+	if len(fi.orphanedLinks) == 0 {
+		return r.finish(outcomeNothingToDo, nil)
+	}
+
+	ops, err := unlinkOps(ltd)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+
+	keepGoing, err := r.ask("Delete orphaned links?", cf.ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecord(ctx.Context, "prune", cf.srcDirs, cf.linkDir, ops)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
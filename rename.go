@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// renameKind is how a renameRule changes a name
+type renameKind string
+
+const (
+	renamePrefix renameKind = "prefix"
+	renameSuffix renameKind = "suffix"
+	renameRegex  renameKind = "regex"
+)
+
+// renameRule changes the name of a src path component into the name of its link, like
+// --dotfiles changing dot-bashrc into .bashrc. Rules are written as
+// <kind><sep><from><sep><to>, where sep is any character not in from or to:
+//   - prefix:dot-:. replaces a leading dot- with .
+//   - suffix:.symlink: removes a trailing .symlink
+//   - regex/^_(.*)$/.$1 replaces matches of the regex, expanding $1 like regexp.ReplaceAllString
+type renameRule struct {
+	// text is the rule as written
+	text string
+	kind renameKind
+	from string
+	to   string
+	// re is the compiled from of regex rules
+	re *regexp.Regexp
+}
+
+func (r renameRule) String() string {
+	return r.text
+}
+
+// dotfilesRule is the rule --dotfiles adds before any other rules
+func dotfilesRule() renameRule {
+	return renameRule{text: "prefix:dot-:.", kind: renamePrefix, from: "dot-", to: ".", re: nil}
+}
+
+// parseRenameRule parses a rule written like renameRule's doc comment shows
+func parseRenameRule(text string) (renameRule, error) {
+	r := renameRule{text: text, kind: "", from: "", to: "", re: nil}
+	for _, kind := range []renameKind{renamePrefix, renameSuffix, renameRegex} {
+		if rest, ok := strings.CutPrefix(text, string(kind)); ok && rest != "" {
+			r.kind = kind
+			_, size := utf8.DecodeRuneInString(rest)
+			sep := rest[:size]
+			parts := strings.Split(rest[size:], sep)
+			if len(parts) != 2 {
+				return r, fmt.Errorf("invalid rename rule (expected %s%s<from>%s<to>): %q", kind, sep, sep, text)
+			}
+			r.from, r.to = parts[0], parts[1]
+			break
+		}
+	}
+	if r.kind == "" {
+		return r, fmt.Errorf("invalid rename rule (expected it to start with %s, %s, or %s, then a separator, like prefix:dot-:.): %q", renamePrefix, renameSuffix, renameRegex, text)
+	}
+	if r.from == "" {
+		return r, fmt.Errorf("invalid rename rule (from must not be empty): %q", text)
+	}
+	if r.kind == renameRegex {
+		re, err := regexp.Compile(r.from)
+		if err != nil {
+			return r, fmt.Errorf("invalid rename rule regex: %q: %w", text, err)
+		}
+		r.re = re
+	}
+	return r, nil
+}
+
+// parseRenameRules parses rules (from --rename or a package's rename), in order
+func parseRenameRules(rules []string) ([]renameRule, error) {
+	ret := make([]renameRule, 0, len(rules))
+	for _, text := range rules {
+		r, err := parseRenameRule(text)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// apply returns name renamed by r, or name if r doesn't match it
+func (r renameRule) apply(name string) string {
+	switch r.kind {
+	case renamePrefix:
+		if rest, ok := strings.CutPrefix(name, r.from); ok {
+			return r.to + rest
+		}
+	case renameSuffix:
+		if rest, ok := strings.CutSuffix(name, r.from); ok {
+			return rest + r.to
+		}
+	case renameRegex:
+		return r.re.ReplaceAllString(name, r.to)
+	}
+	return name
+}
+
+// reverse returns the name r renames to name, or name if r can't have renamed it. Regexes
+// can't be reversed, and rules that remove from (like suffix:.symlink:) could have renamed
+// any name, so they return name too (see renameRules.srcName).
+func (r renameRule) reverse(name string) string {
+	if r.to == "" {
+		return name
+	}
+	switch r.kind {
+	case renamePrefix:
+		if rest, ok := strings.CutPrefix(name, r.to); ok {
+			return r.from + rest
+		}
+	case renameSuffix:
+		if rest, ok := strings.CutSuffix(name, r.to); ok {
+			return rest + r.from
+		}
+	case renameRegex:
+	}
+	return name
+}
+
+// renameRules are applied in order to each component of a src path, each to the name the
+// previous rule returned
+type renameRules []renameRule
+
+// linkName returns the name of the link for the src path component name
+func (rules renameRules) linkName(name string) (string, error) {
+	for _, r := range rules {
+		name = r.apply(name)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("rename rules made an invalid name: %q", name)
+	}
+	return name, nil
+}
+
+// srcName returns the name of the src path component that links to name, by reversing
+// the rules from last to first. The result is checked by renaming it forward, so names no
+// src name is renamed to (like dot-bashrc with --dotfiles) and names only a regex rule
+// renames to are errors.
+func (rules renameRules) srcName(name string) (string, error) {
+	src := name
+	for i := len(rules) - 1; i >= 0; i-- {
+		src = rules[i].reverse(src)
+	}
+	linkName, err := rules.linkName(src)
+	if err != nil || linkName != name {
+		return "", fmt.Errorf("no src name is renamed to %s by rename rules %s", name, rules)
+	}
+	return src, nil
+}
+
+func (rules renameRules) String() string {
+	texts := make([]string, len(rules))
+	for i, r := range rules {
+		texts[i] = r.String()
+	}
+	return "[" + strings.Join(texts, " ") + "]"
+}
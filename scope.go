@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// scope limits a plan to part of the src dirs (--only and --target). Links and dirs outside
+// it are reported as out of scope instead of being acted on. A path is in scope if it
+// matches any --only pattern or is (inside) any --target.
+type scope struct {
+	// only are globs matched against src paths relative to their src dir and link paths
+	// relative to their link dir (see compilePathGlobs). Paths inside a dir that matches are in scope too.
+	only []ignoreRule
+	// targets are absolute src or link paths. Paths inside them are in scope too.
+	targets []string
+}
+
+// contains reports whether lt's src or link path is in s. srcDirs and linkDir are the run's,
+// to make paths relative to their src dir and link dir (see linkDirOf).
+func (s *scope) contains(lt linkT, srcDirs []string, linkDir string, opts fileInfoOpts) bool {
+	for _, t := range s.targets {
+		for _, p := range []string{lt.src, lt.link} {
+			if p == t || isUnderDir(canonicalPath(p), canonicalDir(t)) {
+				return true
+			}
+		}
+	}
+	if len(s.only) == 0 {
+		return false
+	}
+
+	var rels []string
+	if srcDir := srcDirOf(lt.src, srcDirs); srcDir != "" {
+		rel, err := filepath.Rel(canonicalDir(srcDir), canonicalPath(lt.src))
+		if err == nil {
+			rels = append(rels, rel)
+		}
+	}
+	// templates' srcs are rendered files, which aren't in a src dir, so try every link dir
+	for _, ld := range slices.Concat([]string{opts.linkDirOf(lt.src, linkDir)}, opts.linkDirs(srcDirs, linkDir)) {
+		ld, err := filepath.Abs(ld)
+		if err == nil && isUnderDir(lt.link, ld) {
+			rel, err := filepath.Rel(ld, lt.link)
+			if err == nil {
+				rels = append(rels, rel)
+			}
+			break
+		}
+	}
+	info, err := os.Stat(lt.src)
+	isDir := err == nil && info.IsDir()
+	for _, r := range s.only {
+		for _, rel := range rels {
+			if r.matchesRelOrParent(rel, isDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopeLinks returns the entries of lts in opts.scope, and adds the others to fi.outOfScope
+func scopeLinks(fi *fileInfo, lts []linkT, srcDirs []string, linkDir string, opts fileInfoOpts) []linkT {
+	if opts.scope == nil {
+		return lts
+	}
+	return splitScope(fi, lts, func(lt linkT) bool {
+		return opts.scope.contains(lt, srcDirs, linkDir, opts)
+	})
+}
+
+// splitScope returns the entries of lts inScope reports are in scope, and adds the others to fi.outOfScope
+func splitScope(fi *fileInfo, lts []linkT, inScope func(linkT) bool) []linkT {
+	var in []linkT
+	for _, lt := range lts {
+		if inScope(lt) {
+			in = append(in, lt)
+		} else {
+			fi.outOfScope = append(fi.outOfScope, lt)
+		}
+	}
+	slices.SortFunc(fi.outOfScope, compareLinks)
+	return in
+}
+
+// applyScope moves what fi plans for paths outside opts.scope to fi.outOfScope. Dirs to
+// create or unfold stay in scope if links in scope need them. Unfolding a dir removes its
+// dir link, so every link planned in a dir that's unfolded stays in scope too (otherwise
+// the paths linked through it would vanish). Errors about single paths (fi.pathErrs) are
+// kept, since they can be about the src or link dirs themselves.
+func applyScope(fi *fileInfo, srcDirs []string, linkDir string, opts fileInfoOpts) {
+	s := opts.scope
+	if s == nil {
+		return
+	}
+	contains := func(lt linkT) bool {
+		return s.contains(lt, srcDirs, linkDir, opts)
+	}
+	toCreate := slices.Concat(fi.dirLinksToCreate, fi.fileLinksToCreate, fi.identicalFiles, fi.pathsToAdopt, fi.pathsToBackup)
+	var unfolding []linkT
+	for _, d := range fi.dirsToUnfold {
+		if contains(d) || slices.ContainsFunc(toCreate, func(lt linkT) bool { return contains(lt) && isUnderDir(lt.link, d.link) }) {
+			unfolding = append(unfolding, d)
+		}
+	}
+	inScope := func(lt linkT) bool {
+		return contains(lt) || slices.ContainsFunc(unfolding, func(d linkT) bool {
+			return isUnderDir(lt.link, d.link)
+		})
+	}
+
+	fi.dirLinksToCreate = splitScope(fi, fi.dirLinksToCreate, inScope)
+	fi.existingDirLinks = splitScope(fi, fi.existingDirLinks, inScope)
+	fi.existingFileLinks = splitScope(fi, fi.existingFileLinks, inScope)
+	fi.fileLinksToCreate = splitScope(fi, fi.fileLinksToCreate, inScope)
+	fi.identicalFiles = splitScope(fi, fi.identicalFiles, inScope)
+	fi.orphanedLinks = splitScope(fi, fi.orphanedLinks, inScope)
+	fi.pathsToAdopt = splitScope(fi, fi.pathsToAdopt, inScope)
+	fi.pathsToBackup = splitScope(fi, fi.pathsToBackup, inScope)
+
+	var pathsErrs []pathsErr
+	for _, e := range fi.pathsErrs {
+		lt := linkT{src: e.src, link: e.link}
+		if inScope(lt) {
+			pathsErrs = append(pathsErrs, e)
+		} else {
+			fi.outOfScope = append(fi.outOfScope, lt)
+		}
+	}
+	fi.pathsErrs = pathsErrs
+
+	// dirs stay in scope if links in scope are created in them
+	inScopeLinks := slices.Concat(fi.dirLinksToCreate, fi.fileLinksToCreate, fi.identicalFiles, fi.pathsToAdopt, fi.pathsToBackup)
+	needed := func(d linkT) bool {
+		return inScope(d) || slices.ContainsFunc(inScopeLinks, func(lt linkT) bool {
+			return isUnderDir(lt.link, d.link)
+		})
+	}
+	fi.dirsToCreate = splitScope(fi, fi.dirsToCreate, needed)
+	fi.dirsToUnfold = splitScope(fi, fi.dirsToUnfold, needed)
+
+	// templates are only rendered for their links in scope
+	linked := make(map[string]bool)
+	for _, lt := range slices.Concat(fi.fileLinksToCreate, fi.existingFileLinks, fi.pathsToBackup) {
+		linked[lt.src] = true
+	}
+	fi.templatesToRender = slices.DeleteFunc(fi.templatesToRender, func(t templateToRender) bool {
+		return !linked[t.generated]
+	})
+	fi.chosenAlternates = slices.DeleteFunc(fi.chosenAlternates, func(ca chosenAlternate) bool {
+		return !contains(linkT{src: ca.src, link: ca.link})
+	})
+}
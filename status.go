@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+)
+
+// status exit codes. 1 is left for other errors (bad flags, unreadable dirs, ...)
+const (
+	statusExitLinked  = 0
+	statusExitPending = 2
+	statusExitErrors  = 3
+)
+
+// statusExitCode returns the exit code fling status should use for fi
+func statusExitCode(fi *fileInfo) int {
+	if len(fi.pathErrs) > 0 || len(fi.pathsErrs) > 0 {
+		return statusExitErrors
+	}
+	if hasLinksToCreate(fi) || len(fi.orphanedLinks) > 0 {
+		return statusExitPending
+	}
+	return statusExitLinked
+}
+
+func status(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+	// show what link would do
+	cf.opts.unfold = true
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	exitCode := statusExitCode(fi)
+	{
+		f := bufio.NewWriter(os.Stdout)
+		fPrintLinkPlan(f, &color, fi)
+		fPrintOrphanedLinks(f, &color, fi)
+		fPrintPathErrs(f, &color, fi)
+
+		switch exitCode {
+		case statusExitLinked:
+			fmt.Fprint(f, color.Add(color.Bold+color.FgGreenBright, "Fully linked!\n"))
+		case statusExitPending:
+			fmt.Fprint(f, color.Add(color.Bold+color.FgYellow, "Changes pending\n"))
+		case statusExitErrors:
+			fmt.Fprint(f, color.Add(color.Bold+color.FgRed, "Errors found\n"))
+		}
+		f.Flush()
+	}
+
+	if exitCode != statusExitLinked {
+		return exitCodeError{code: exitCode, err: nil}
+	}
+	return nil
+}
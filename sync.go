@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go.bbkane.com/gocolor"
+	"go.bbkane.com/warg"
+)
+
+// findStaleLinks returns the links into srcDirs that don't correspond to a link
+// fling would make for the current layout of srcDirs (see findLinksIntoSrcDirs).
+// These are usually left over after renaming or moving paths in a src dir. Links to
+// ignored paths (or paths in ignored dirs) are left alone.
+func findStaleLinks(linkDirs []string, srcDirs []string, fi *fileInfo) ([]linkT, error) {
+	links, err := findLinksIntoSrcDirs(linkDirs, srcDirs, fi)
+	if err != nil {
+		return nil, err
+	}
+
+	// links fling already knows what to do with (or to leave alone)
+	known := make(map[string]bool)
+	for _, e := range slices.Concat(fi.existingDirLinks, fi.existingFileLinks, fi.dirsToUnfold, fi.pathsToBackup, fi.outOfScope) {
+		known[e.link] = true
+	}
+
+	// like a README.md linked by hand
+	var ignored []string
+	for _, e := range fi.ignoredPaths {
+		ignored = append(ignored, canonicalPath(e.path))
+	}
+	isIgnored := func(src string) bool {
+		return slices.ContainsFunc(ignored, func(p string) bool {
+			return src == p || isUnderDir(src, p)
+		})
+	}
+
+	var stale []linkT
+	for _, l := range links {
+		if !known[l.link] && !isIgnored(l.src) {
+			stale = append(stale, l)
+		}
+	}
+	return stale, nil
+}
+
+// replaceStaleLinks plans to create links in place of stale links. When a src path
+// needs a link path that's taken by a stale link, buildFileInfo reports a pathsErr. Once
+// the stale link is deleted, the link can be created instead, so the pathsErr is moved
+// to the dir or file links to create.
+func replaceStaleLinks(fi *fileInfo, staleLinks []linkT, linkDir string, opts fileInfoOpts) error {
+	stale := make(map[string]bool)
+	for _, l := range staleLinks {
+		stale[l.link] = true
+	}
+	errCount := make(map[string]int)
+	for _, e := range fi.pathsErrs {
+		errCount[e.link]++
+	}
+
+	var pathsErrs []pathsErr
+	for _, e := range fi.pathsErrs {
+		// conflicts between several src paths for the same link can't be fixed this way
+		if !stale[e.link] || errCount[e.link] > 1 {
+			pathsErrs = append(pathsErrs, e)
+			continue
+		}
+		srcInfo, err := os.Stat(e.src)
+		if err != nil {
+			pathsErrs = append(pathsErrs, e)
+			continue
+		}
+		ltc := linkT{src: e.src, link: e.link}
+		ld, err := filepath.Abs(opts.linkDirOf(e.src, linkDir))
+		if err != nil {
+			return fmt.Errorf("couldn't get abs path for linkDir: %w", err)
+		}
+		switch {
+		case !srcInfo.IsDir():
+			fi.fileLinksToCreate = append(fi.fileLinksToCreate, ltc)
+		case !isNoFoldDir(opts, e.src, e.link, ld):
+			fi.dirLinksToCreate = append(fi.dirLinksToCreate, ltc)
+		default:
+			// a real dir would need its children planned too. Running sync again after this one will do that
+			pathsErrs = append(pathsErrs, e)
+		}
+	}
+	fi.pathsErrs = pathsErrs
+	slices.SortFunc(fi.dirLinksToCreate, compareLinks)
+	slices.SortFunc(fi.fileLinksToCreate, compareLinks)
+	return nil
+}
+
+func syncCmd(ctx warg.CmdContext) error {
+	cf, err := getCommonFlags(ctx)
+	if err != nil {
+		return err
+	}
+	linkStyle := ctx.Flags["--link-style"].(string)
+	cf.opts.onConflict = ctx.Flags["--on-conflict"].(string)
+	cf.opts.unfold = true
+
+	color, err := gocolor.Prepare(warg.ColorEnabled(ctx.Flags, ctx.Stdout))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error enabling color. Continuing without: %v\n", err)
+	}
+
+	fi, err := buildCombinedFileInfo(cf.srcDirs, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+
+	staleLinks, err := findStaleLinks(cf.opts.linkDirs(cf.srcDirs, cf.linkDir), cf.srcDirs, fi)
+	if err != nil {
+		return err
+	}
+	staleLinks = scopeLinks(fi, staleLinks, cf.srcDirs, cf.linkDir, cf.opts)
+	err = replaceStaleLinks(fi, staleLinks, cf.linkDir, cf.opts)
+	if err != nil {
+		return err
+	}
+	annotateFromManifest(fi, cf.srcDirs)
+
+	// the dirs stale links are in might be needed for the new links, so don't clean them up
+	ltd := &linksToDelete{
+		links:             staleLinks,
+		emptyDirsToDelete: nil,
+		dirsToRefold:      nil,
+		backupsToRestore:  nil,
+	}
+
+	r := newReporter(formatText, &color, "sync")
+
+	// Print fileInfo
+	{
+		f := bufio.NewWriter(os.Stdout)
+		if len(staleLinks) > 0 {
+			fPrintHeader(f, &color, "Stale links to delete:")
+			fPrintLinkTs(f, &color, staleLinks)
+			fmt.Fprintln(f)
+		}
+		fPrintLinkPlan(f, &color, fi)
+		fPrintPathErrs(f, &color, fi)
+		f.Flush()
+	}
+
+	if len(fi.pathsErrs) > 0 {
+		return r.finish(outcomeErrors, errors.New("resolve errors above before syncing links"))
+	}
+
+	if len(staleLinks) == 0 && !hasLinksToCreate(fi) {
+		return r.finish(outcomeNothingToDo, nil)
+	}
+
+	deleteOps, err := unlinkOps(ltd)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	createOps, err := linkOps(fi, linkStyle)
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	// check before asking, so paths that can't be adopted (like ones on another filesystem) are reported first
+	err = checkOps(slices.Concat(deleteOps, createOps))
+	if err != nil {
+		return r.finish(outcomeErrors, err)
+	}
+
+	keepGoing, err := r.ask("Delete stale links and create links?", cf.ask)
+	if !keepGoing {
+		if err == nil {
+			return r.finish(outcomeDryRun, nil)
+		}
+		return r.finish(outcomeAborted, err)
+	}
+
+	err = applyAndRecord(ctx.Context, "sync", cf.srcDirs, cf.linkDir, slices.Concat(deleteOps, createOps))
+	if err != nil {
+		return r.finish(outcomeFailed, err)
+	}
+	return r.finish(outcomeDone, nil)
+}
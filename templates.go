@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"go.bbkane.com/gocolor"
+	"gopkg.in/yaml.v3"
+)
+
+// templateExt marks src files (like dot-gitconfig.tmpl) that are rendered with text/template
+// into the generated dir. They're linked without the extension, to the rendered file.
+const templateExt = ".tmpl"
+
+// templateData is what templates are rendered with, like {{ .Hostname }} or {{ .Data.email }}
+type templateData struct {
+	Hostname string
+	// OS is runtime.GOOS
+	OS   string
+	User string
+	Home string
+	Env  map[string]string
+	// Data is the contents of the template data file
+	Data map[string]any
+}
+
+// templateOpts are how buildFileInfo renders templates
+type templateOpts struct {
+	// generatedDir is the dir templates are rendered into. The rendered file mirrors the
+	// absolute path of its template, so templates from every src dir can share it.
+	generatedDir string
+	data         templateData
+}
+
+// templateToRender is a template whose rendered file in the generated dir is missing or out of date
+type templateToRender struct {
+	src string
+	// generated is the path src is rendered to, which its link points to
+	generated string
+	content   string
+	// mode is src's permissions, so rendered scripts stay executable
+	mode fs.FileMode
+}
+
+func (t templateToRender) ColorString(color *gocolor.Color) string {
+	return fmt.Sprintf(
+		"- %s: %s\n  %s: %s",
+		color.Add(color.Bold, "src"),
+		t.src,
+		color.Add(color.Bold, "generated"),
+		t.generated,
+	)
+}
+
+// compareTemplates sorts templateToRenders by src
+func compareTemplates(a, b templateToRender) int {
+	return cmp.Compare(a.src, b.src)
+}
+
+// generatedDir returns the dir fling renders templates into
+func generatedDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "generated"), nil
+}
+
+// defaultTemplateDataPath returns $XDG_CONFIG_HOME/fling/data.yaml, or ~/.config/fling/data.yaml.
+// It's machine-local (not in a src dir), so it can hold values that differ between machines.
+func defaultTemplateDataPath() (string, error) {
+	// the spec says relative paths are invalid and should be ignored
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(xdgConfigHome) {
+		return filepath.Join(xdgConfigHome, "fling", "data.yaml"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find template data file: %w", err)
+	}
+	return filepath.Join(home, ".config", "fling", "data.yaml"), nil
+}
+
+// readTemplateData reads the YAML mapping in the template data file at p. A missing file
+// is empty unless mustExist.
+func readTemplateData(p string, mustExist bool) (map[string]any, error) {
+	data := make(map[string]any)
+	content, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) && !mustExist {
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read template data file: %w", err)
+	}
+	err = yaml.Unmarshal(content, &data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode template data file (it should be a YAML mapping): %s: %w", p, err)
+	}
+	if data == nil {
+		// the file is empty
+		data = make(map[string]any)
+	}
+	return data, nil
+}
+
+// newTemplateOpts gathers the facts about m and the current user that templates are
+// rendered with, along with the template data file at dataPath
+func newTemplateOpts(m machineFacts, dataPath string, mustExist bool) (*templateOpts, error) {
+	genDir, err := generatedDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readTemplateData(dataPath, mustExist)
+	if err != nil {
+		return nil, err
+	}
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = ""
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return &templateOpts{
+		generatedDir: genDir,
+		data: templateData{
+			Hostname: m.host,
+			OS:       m.os,
+			User:     username,
+			Home:     home,
+			Env:      env,
+			Data:     data,
+		},
+	}, nil
+}
+
+// generatedPath returns where the template at the absolute path src is rendered to:
+// its path under genDir, without an alternate's ##suffix or the template extension
+func generatedPath(genDir string, src string) string {
+	// C: can't be part of a path on Windows
+	vol := filepath.VolumeName(src)
+	name, _, _ := strings.Cut(filepath.Base(src), alternateSep)
+	name = strings.TrimSuffix(name, templateExt)
+	return filepath.Join(genDir, strings.TrimSuffix(vol, ":"), filepath.Dir(src[len(vol):]), name)
+}
+
+// renderTemplate renders the template at src with data. Missing keys are errors, so typos
+// don't silently render as "<no value>".
+func renderTemplate(src string, data templateData) (string, error) {
+	text, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// contentHash returns the sha256 of content, in hex
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// renderWriteFiles renders the templates of the write_file ops in ops again, since
+// only their hash is saved. checkOps then checks they render to what was planned.
+func renderWriteFiles(ops []op, t *templateOpts) error {
+	for i, o := range ops {
+		if o.Kind != opWriteFile {
+			continue
+		}
+		content, err := renderTemplate(o.Src, t.data)
+		if err != nil {
+			return fmt.Errorf("couldn't render template: %s: %w", o.Src, err)
+		}
+		ops[i].content = content
+	}
+	return nil
+}
+
+// generatedUpToDate reports whether the file at generated has content and mode
+func generatedUpToDate(generated string, content string, mode fs.FileMode) (bool, error) {
+	info, err := os.Stat(generated)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, errors.New("generated path is not a regular file")
+	}
+	if info.Mode().Perm() != mode || info.Size() != int64(len(content)) {
+		return false, nil
+	}
+	existing, err := os.ReadFile(generated)
+	if err != nil {
+		return false, err
+	}
+	return string(existing) == content, nil
+}
+
+// planTemplateRender renders the template at srcPath and adds it to fi.templatesToRender if its
+// rendered file is out of date. It returns the rendered file's path, or false if there was
+// an error (added to fi.pathErrs).
+func planTemplateRender(fi *fileInfo, t *templateOpts, srcPath string) (string, bool) {
+	generated := generatedPath(t.generatedDir, srcPath)
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		fi.pathErrs = append(fi.pathErrs, pathErr{path: srcPath, err: err})
+		return "", false
+	}
+	content, err := renderTemplate(srcPath, t.data)
+	if err != nil {
+		fi.pathErrs = append(fi.pathErrs, pathErr{path: srcPath, err: fmt.Errorf("couldn't render template: %w", err)})
+		return "", false
+	}
+	upToDate, err := generatedUpToDate(generated, content, srcInfo.Mode().Perm())
+	if err != nil {
+		fi.pathErrs = append(fi.pathErrs, pathErr{path: generated, err: fmt.Errorf("couldn't compare with rendered template: %w", err)})
+		return "", false
+	}
+	if !upToDate {
+		fi.templatesToRender = append(fi.templatesToRender, templateToRender{
+			src:       srcPath,
+			generated: generated,
+			content:   content,
+			mode:      srcInfo.Mode().Perm(),
+		})
+	}
+	return generated, true
+}
+
+// planTemplateLink classifies the link to the rendered file of the template at srcPath,
+// given the Lstat of linkPath. Templates can't be adopted (that would replace the template
+// with a rendered file) and files identical to the rendered file aren't replaced (the
+// rendered file might not exist yet), so everything in the way of the link is a conflict.
+func planTemplateLink(fi *fileInfo, opts fileInfoOpts, srcPath string, linkPath string, linkInfo fs.FileInfo, linkErr error) {
+	generated, ok := planTemplateRender(fi, opts.templates, srcPath)
+	if !ok {
+		return
+	}
+	lt := linkT{src: generated, link: linkPath}
+	if errors.Is(linkErr, fs.ErrNotExist) {
+		fi.fileLinksToCreate = append(fi.fileLinksToCreate, lt)
+		return
+	}
+	if linkErr != nil {
+		fi.pathErrs = append(fi.pathErrs, pathErr{path: linkPath, err: linkErr})
+		return
+	}
+
+	var conflict error
+	switch {
+	case linkInfo.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			fi.pathErrs = append(fi.pathErrs, pathErr{path: linkPath, err: err})
+			return
+		}
+		if linkPointsTo(linkPath, target, generated) {
+			fi.existingFileLinks = append(fi.existingFileLinks, lt)
+			return
+		}
+		conflict = fmt.Errorf("link is already a symlink to src: %s", target)
+	case linkInfo.IsDir():
+		fi.pathsErrs = append(fi.pathsErrs, pathsErr{
+			src:  srcPath,
+			link: linkPath,
+			err:  errors.New("link is existing dir and src is a template"),
+		})
+		return
+	default:
+		conflict = errors.New("link is an existing file. Templates can't be adopted, so copy it into the template and delete it, or use --on-conflict backup")
+	}
+	if opts.onConflict == "backup" {
+		fi.pathsToBackup = append(fi.pathsToBackup, lt)
+		return
+	}
+	fi.pathsErrs = append(fi.pathsErrs, pathsErr{src: srcPath, link: linkPath, err: conflict})
+}